@@ -5,5 +5,54 @@ type App struct {
 	Host string
 	Port uint16
 
+	Status   string
+	Restarts int
+	Rollout  *Rollout
+
+	WatchLeft uint64
+	Rollback  *Rollback
+	Shadow    *Shadow
+
 	Instances []*Instance
 }
+
+type Rollout struct {
+	Step   int
+	Steps  int
+	Weight int
+}
+
+// Shadow compares responses of shadowed instance with active instances,
+// latencies are averages in milliseconds
+type Shadow struct {
+	Instance      uint32
+	Running       bool
+	Left          uint64
+	Requests      int64
+	Mismatches    int64
+	Errors        int64
+	Dropped       int64
+	ActiveLatency float64
+	ShadowLatency float64
+}
+
+type Rollback struct {
+	Time              int64
+	Instances         []uint32
+	ErrorRate         float64
+	BaselineErrorRate float64
+}
+
+// RestartProgress reports events of restart and its outcome, Error is set
+// if restart failed
+type RestartProgress struct {
+	Id     uint32
+	Events []*ProgressEvent
+	Done   bool
+	Error  string
+}
+
+type ProgressEvent struct {
+	Time    int64
+	Message string
+}
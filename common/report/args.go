@@ -0,0 +1,33 @@
+package report
+
+// AppArgs are arguments of app management rpc calls. Config is app config
+// in yaml format, if Persist is set the change is also written to config
+// files.
+type AppArgs struct {
+	Name    string
+	Config  []byte
+	Persist bool
+}
+
+// RestartArgs are arguments of restart rpc call. If Hold is set new
+// instances do not receive traffic until they are promoted.
+type RestartArgs struct {
+	Name string
+	Hold bool
+}
+
+// MatchArgs select apps for bulk commands by glob patterns of app names,
+// app groups or all apps
+type MatchArgs struct {
+	Patterns []string
+	Groups   []string
+	All      bool
+}
+
+// ProgressArgs are arguments of restart progress rpc call, events are
+// returned starting with From
+type ProgressArgs struct {
+	Name string
+	Id   uint32
+	From int
+}
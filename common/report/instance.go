@@ -3,9 +3,35 @@ package report
 type Instance struct {
 	Id                uint32
 	Active            bool
+	Canary            bool
 	Host              string
 	Port              uint16
 	Status            string
+	Unhealthy         bool
+	NotifyState       string
+	NotifyStatus      string
 	SinceStatusChange uint64
 	Error             string
+
+	ProxyErrors            uint64
+	ConsecutiveProxyErrors uint64
+	InFlight               int64
+	StopStep               int
+	StopSteps              int
+	StopSignal             string
+	Orphans                []int
+}
+
+// InstanceRecord is compact report of exited instance kept in app history
+type InstanceRecord struct {
+	Id     uint32
+	Port   uint16
+	Status string
+
+	ExitCode int
+	Signal   string
+	Started  int64
+	Ended    int64
+	Orphans  []int
+	Error    string
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/rpc"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -39,6 +43,113 @@ func basicRpcCall(client *rpc.Client, method string, args interface{}) {
 	}
 }
 
+// ProgressPollInterval is how often restart progress is polled with --wait
+const ProgressPollInterval = 200 * time.Millisecond
+
+func restartRpcCall(client *rpc.Client, args report.RestartArgs, wait bool, timeout time.Duration) {
+	if err := restartApp(client, args, wait, timeout, ""); err != nil {
+		log.Fatal("error:", err)
+	}
+}
+
+// restartApp restarts app and, if wait is set, prints progress with prefix
+// until restart finishes
+func restartApp(client *rpc.Client, args report.RestartArgs, wait bool, timeout time.Duration, prefix string) error {
+	var id uint32
+	err := client.Call("Rpc.Restart", args, &id)
+	if err != nil {
+		return err
+	}
+	if !wait {
+		return nil
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	from := 0
+	for {
+		var progress report.RestartProgress
+		err := client.Call("Rpc.RestartProgress", report.ProgressArgs{Name: args.Name, Id: id, From: from}, &progress)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range progress.Events {
+			fmt.Printf("%s %s%s\n", time.Unix(0, event.Time).Format("15:04:05"), prefix, event.Message)
+		}
+		from += len(progress.Events)
+
+		if progress.Done {
+			if progress.Error != "" {
+				return fmt.Errorf("restart failed: %s", progress.Error)
+			}
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("restart did not finish in %s", timeout)
+		}
+		time.Sleep(ProgressPollInterval)
+	}
+}
+
+// bulkRestartRpcCall restarts matching apps one after another, at most
+// parallel at once, and waits for each restart to finish. Remaining apps are
+// not restarted after a failure unless continueOnError is set.
+func bulkRestartRpcCall(client *rpc.Client, match report.MatchArgs, hold bool, timeout time.Duration, parallel int, continueOnError bool) {
+	var names []string
+	err := client.Call("Rpc.MatchApps", match, &names)
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+	skipped := []string{}
+	slots := make(chan struct{}, parallel)
+	for i, name := range names {
+		slots <- struct{}{}
+		lock.Lock()
+		stop := len(failed) > 0 && !continueOnError
+		lock.Unlock()
+		if stop {
+			skipped = names[i:]
+			break
+		}
+
+		wg.Add(1)
+		go func(name string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			prefix := fmt.Sprintf("[%s] ", name)
+			if err := restartApp(client, report.RestartArgs{Name: name, Hold: hold}, true, timeout, prefix); err != nil {
+				fmt.Printf("%s %serror: %s\n", time.Now().Format("15:04:05"), prefix, err)
+				lock.Lock()
+				failed = append(failed, name)
+				lock.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if len(skipped) > 0 {
+		fmt.Printf("Not restarted: %s\n", strings.Join(skipped, ", "))
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		log.Fatalf("error: restart failed: %s", strings.Join(failed, ", "))
+	}
+}
+
 func statusRpcCall(client *rpc.Client, args interface{}) {
 	var reply []*report.App
 	err := client.Call("Rpc.Status", args, &reply)
@@ -48,21 +159,72 @@ func statusRpcCall(client *rpc.Client, args interface{}) {
 
 	tabWriter := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', 0)
 	for _, appReport := range reply {
-		fmt.Fprintf(tabWriter, "[%s/%s:%d]\n", appReport.Name, appReport.Host, appReport.Port)
+		fmt.Fprintf(tabWriter, "[%s/%s:%d] %s", appReport.Name, appReport.Host, appReport.Port, appReport.Status)
+		if appReport.Restarts > 0 {
+			fmt.Fprintf(tabWriter, " (retries: %d)", appReport.Restarts)
+		}
+		if appReport.Rollout != nil {
+			if appReport.Rollout.Step > 0 {
+				fmt.Fprintf(tabWriter, " (rollout: step %d/%d, %d%%)", appReport.Rollout.Step, appReport.Rollout.Steps, appReport.Rollout.Weight)
+			} else {
+				fmt.Fprint(tabWriter, " (rollout: starting)")
+			}
+		}
+		if appReport.WatchLeft > 0 {
+			fmt.Fprintf(tabWriter, " (watching: %s left)", time.Duration(appReport.WatchLeft)*time.Second)
+		}
+		if rollback := appReport.Rollback; rollback != nil {
+			fmt.Fprintf(tabWriter, " (rolled back %v %s ago: error rate %.1f%%, baseline %.1f%%)",
+				rollback.Instances, time.Since(time.Unix(rollback.Time, 0))/time.Second*time.Second,
+				rollback.ErrorRate, rollback.BaselineErrorRate)
+		}
+		if shadow := appReport.Shadow; shadow != nil {
+			if shadow.Running {
+				fmt.Fprintf(tabWriter, " (shadowing instance %d: %s left,", shadow.Instance, time.Duration(shadow.Left)*time.Second)
+			} else {
+				fmt.Fprintf(tabWriter, " (shadowed instance %d:", shadow.Instance)
+			}
+			fmt.Fprintf(tabWriter, " %d requests, %d status mismatches, %d errors, %d dropped, latency %.1fms vs %.1fms active)",
+				shadow.Requests, shadow.Mismatches, shadow.Errors, shadow.Dropped, shadow.ShadowLatency, shadow.ActiveLatency)
+		}
+		fmt.Fprint(tabWriter, "\n")
 
 		for _, instanceReport := range appReport.Instances {
 			if instanceReport.Active {
 				fmt.Fprint(tabWriter, "*\t")
+			} else if instanceReport.Canary {
+				fmt.Fprint(tabWriter, "+\t")
 			} else {
 				fmt.Fprint(tabWriter, "\t")
 			}
 
 			fmt.Fprintf(tabWriter, "%d/%s:%d\t", instanceReport.Id, instanceReport.Host, instanceReport.Port)
 
-			fmt.Fprintf(tabWriter, "%s\t", instanceReport.Status)
+			status := instanceReport.Status
+			if instanceReport.Unhealthy {
+				status += " (unhealthy)"
+			}
+			if instanceReport.ProxyErrors > 0 {
+				status += fmt.Sprintf(" (proxy errors: %d, %d in a row)", instanceReport.ProxyErrors, instanceReport.ConsecutiveProxyErrors)
+			}
+			if instanceReport.InFlight > 0 {
+				status += fmt.Sprintf(" (in-flight: %d)", instanceReport.InFlight)
+			}
+			if instanceReport.StopStep > 0 {
+				status += fmt.Sprintf(" (step %d/%d: %s)", instanceReport.StopStep, instanceReport.StopSteps, instanceReport.StopSignal)
+			}
+			if len(instanceReport.Orphans) > 0 {
+				status += fmt.Sprintf(" (killed orphans: %v)", instanceReport.Orphans)
+			}
+			if instanceReport.NotifyState != "" {
+				status += fmt.Sprintf(" [%s]", instanceReport.NotifyState)
+			}
+			fmt.Fprintf(tabWriter, "%s\t", status)
 
 			fmt.Fprintf(tabWriter, "%s\t", time.Duration(instanceReport.SinceStatusChange)*time.Second)
 
+			fmt.Fprintf(tabWriter, "%s\t", instanceReport.NotifyStatus)
+
 			fmt.Fprintf(tabWriter, "%s\n", instanceReport.Error)
 		}
 	}
@@ -70,6 +232,63 @@ func statusRpcCall(client *rpc.Client, args interface{}) {
 	tabWriter.Flush()
 }
 
+func historyRpcCall(client *rpc.Client, args interface{}) {
+	var reply []*report.InstanceRecord
+	err := client.Call("Rpc.History", args, &reply)
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+
+	tabWriter := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', 0)
+	for _, record := range reply {
+		started := time.Unix(record.Started, 0)
+		ended := time.Unix(record.Ended, 0)
+
+		fmt.Fprintf(tabWriter, "%d/%d\t", record.Id, record.Port)
+		status := record.Status
+		if len(record.Orphans) > 0 {
+			status += fmt.Sprintf(" (killed orphans: %v)", record.Orphans)
+		}
+		fmt.Fprintf(tabWriter, "%s\t", status)
+		fmt.Fprintf(tabWriter, "%s\t", started.Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(tabWriter, "%s\t", ended.Sub(started))
+
+		if record.Signal != "" {
+			fmt.Fprintf(tabWriter, "signal: %s\t", record.Signal)
+		} else {
+			fmt.Fprintf(tabWriter, "exit code: %d\t", record.ExitCode)
+		}
+
+		fmt.Fprintf(tabWriter, "%s\n", record.Error)
+	}
+
+	tabWriter.Flush()
+}
+
+func appConfigArgs(c *cli.Context) report.AppArgs {
+	if c.String("file") == "" {
+		log.Fatal("error: app config file must be specified with -f")
+	}
+	data, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+	return report.AppArgs{Config: data, Persist: c.Bool("persist")}
+}
+
+var persistFlag = cli.BoolFlag{
+	Name:  "persist",
+	Usage: "write the change to apps_include config files",
+}
+
+var appFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "file, f",
+		Usage: "app config file",
+	},
+	persistFlag,
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "gracevisorctl"
@@ -97,11 +316,109 @@ func main() {
 				statusRpcCall(getRpcClient(c), c.Args().First())
 			},
 		},
+		{
+			Name:  "reload",
+			Usage: "reload config and apply changes to apps",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Reload", "")
+			},
+		},
+		{
+			Name:  "app",
+			Usage: "add, update or remove applications",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "add application from yaml config file",
+					Flags: appFlags,
+					Action: func(c *cli.Context) {
+						basicRpcCall(getRpcClient(c), "AddApp", appConfigArgs(c))
+					},
+				},
+				{
+					Name:  "update",
+					Usage: "update application from yaml config file",
+					Flags: appFlags,
+					Action: func(c *cli.Context) {
+						basicRpcCall(getRpcClient(c), "UpdateApp", appConfigArgs(c))
+					},
+				},
+				{
+					Name:  "rm",
+					Usage: "stop and remove application",
+					Flags: []cli.Flag{persistFlag},
+					Action: func(c *cli.Context) {
+						basicRpcCall(getRpcClient(c), "RemoveApp", report.AppArgs{
+							Name:    c.Args().First(),
+							Persist: c.Bool("persist"),
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:  "upgrade",
+			Usage: "re-execute daemon binary without stopping applications",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Upgrade", "")
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "display exited application instances",
+			Action: func(c *cli.Context) {
+				historyRpcCall(getRpcClient(c), c.Args().First())
+			},
+		},
 		{
 			Name:  "restart",
 			Usage: "restart application",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "hold",
+					Usage: "start new instances without switching traffic to them until promote",
+				},
+				cli.BoolFlag{
+					Name:  "wait",
+					Usage: "print progress and wait until restart finishes, exit with error if it fails",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "give up waiting after timeout, e.g. 2m",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "restart all apps",
+				},
+				cli.StringSliceFlag{
+					Name:  "group, g",
+					Value: &cli.StringSlice{},
+					Usage: "restart apps in group, can be repeated",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 1,
+					Usage: "number of apps restarted at once in bulk restart",
+				},
+				cli.BoolFlag{
+					Name:  "continue-on-error",
+					Usage: "restart remaining apps when one fails in bulk restart",
+				},
+			},
 			Action: func(c *cli.Context) {
-				basicRpcCall(getRpcClient(c), "Restart", c.Args().First())
+				args := c.Args()
+				if c.Bool("all") || len(c.StringSlice("group")) > 0 || len(args) > 1 || strings.ContainsAny(args.First(), "*?[") {
+					bulkRestartRpcCall(getRpcClient(c), report.MatchArgs{
+						Patterns: args,
+						Groups:   c.StringSlice("group"),
+						All:      c.Bool("all"),
+					}, c.Bool("hold"), c.Duration("timeout"), c.Int("parallel"), c.Bool("continue-on-error"))
+					return
+				}
+				restartRpcCall(getRpcClient(c), report.RestartArgs{
+					Name: args.First(),
+					Hold: c.Bool("hold"),
+				}, c.Bool("wait"), c.Duration("timeout"))
 			},
 		},
 		{
@@ -111,6 +428,34 @@ func main() {
 				basicRpcCall(getRpcClient(c), "Start", c.Args().First())
 			},
 		},
+		{
+			Name:  "promote",
+			Usage: "finish rollout or move all traffic to held instances",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Promote", c.Args().First())
+			},
+		},
+		{
+			Name:  "abort",
+			Usage: "abort rollout and move all traffic back to old instances",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Abort", c.Args().First())
+			},
+		},
+		{
+			Name:  "discard",
+			Usage: "stop held instances instead of promoting them",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Discard", c.Args().First())
+			},
+		},
+		{
+			Name:  "reset",
+			Usage: "clear fatal state and start application",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Reset", c.Args().First())
+			},
+		},
 		{
 			Name:  "stop",
 			Usage: "stop running instances",
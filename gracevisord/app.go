@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"sort"
 	"sync"
@@ -16,6 +20,15 @@ import (
 var (
 	ErrNoActiveInstances  = errors.New("No active instances")
 	ErrInstanceNotRunning = errors.New("Instance is not running")
+	ErrAppFatal           = errors.New("App gave up restarting, reset it first")
+)
+
+const (
+	AppStatusRunning  = "running"
+	AppStatusStarting = "starting"
+	AppStatusBackoff  = "backoff"
+	AppStatusFatal    = "fatal"
+	AppStatusStopped  = "stopped"
 )
 
 type InstanceStatusSort []*Instance
@@ -38,111 +51,555 @@ func (v InstanceStatusSort) Less(i, j int) bool {
 type App struct {
 	config *AppConfig
 
-	instances          []*Instance
-	activeInstance     *Instance
+	// instances and instance state are owned by supervisor goroutine
+	instances    []*Instance
+	history      []*report.InstanceRecord
+	replacing    []*Instance
+	restartCount int
+	restartTimer *time.Timer
+	fatal        bool
+	rollout      *Rollout
+	watch        *Watch
+	lastRollback *report.Rollback
+	lastShadow   *report.Shadow
+
+	// held are instances started with hold that wait to be promoted
+	held []*Instance
+
+	// progress records the last restart
+	progress   *Progress
+	progressId uint32
+
+	// activeInstances and canaryInstances are only changed by supervisor
+	// and are never modified in place, proxies read them under
+	// activeInstanceLock together with serving instances reachable with
+	// debug routing and shadow in progress
+	activeInstances    []*Instance
+	canaryInstances    []*Instance
+	canaryWeight       int
+	servingInstances   map[uint32]*Instance
+	debugRouting       *DebugRoutingConfig
+	shadow             *Shadow
 	activeInstanceLock sync.RWMutex
+	balancer           Balancer
+
+	events  chan *InstanceEvent
+	actions chan func()
 
 	rp       *ReverseProxy
 	portPool *PortPool
 
+	// listener, server and externalHostPort are owned by supervisor, proxy
+	// serves until listener is closed
+	listener         net.Listener
+	server           *http.Server
 	externalHostPort string
 
 	instanceId uint32
 
 	appLogger *AppLogger
+
+	// retiredLoggers are replaced app loggers still used by running
+	// instances
+	retiredLoggers []*AppLogger
+
+	// supervisor stops when app is shut down and all its instances exited,
+	// stopped is closed then
+	shutdown    bool
+	stopped     chan struct{}
+	stoppedLock sync.Mutex
 }
 
 func NewApp(config *AppConfig, portPool *PortPool) *App {
 	app := &App{
-		config:           config,
-		instances:        make([]*Instance, 0, 10),
-		portPool:         portPool,
-		externalHostPort: fmt.Sprintf("%s:%d", config.ExternalHost, config.ExternalPort),
+		config:    config,
+		instances: make([]*Instance, 0, 10),
+		balancer:  NewBalancer(config.Balance),
+		events:    make(chan *InstanceEvent),
+		actions:   make(chan func()),
+		stopped:   make(chan struct{}),
+		portPool:  portPool,
+
+		servingInstances: map[uint32]*Instance{},
+		debugRouting:     config.DebugRouting,
 	}
 
-	app.appLogger = NewAppLogger(app)
+	app.appLogger = NewAppLogger(config)
 	app.rp = &ReverseProxy{App: app}
 
-	app.startInstanceUpdater()
+	go app.supervise()
 
 	return app
 }
 
-func (a *App) startInstanceUpdater() {
-	ticker := time.NewTicker(time.Second)
+// supervise owns all app and instance state. Instances push their state
+// changes as events and other goroutines run actions through do.
+func (a *App) supervise() {
+	for {
+		select {
+		case event := <-a.events:
+			a.handleEvent(event)
+		case action := <-a.actions:
+			action()
+		}
+		a.checkProgress()
 
-	restartCount := 0
+		if a.shutdown && a.terminated() {
+			a.closeRetiredLoggers()
+			a.appLogger.Close()
+			close(a.stopped)
+			return
+		}
+	}
+}
 
-	go func() {
-		// TODO refactor this. Instances should trigger status changes.
-		for {
-			lastStatus := -1
-
-			for _, instance := range a.instances {
-				status := instance.UpdateStatus()
-				lastStatus = status
-
-				if instance == a.activeInstance {
-					if status != InstanceStatusServing {
-						a.activeInstance = nil
-					}
-				} else {
-					if status == InstanceStatusServing {
-						restartCount = 0
-						a.activeInstanceLock.Lock()
-						currentActive := a.activeInstance
-						a.activeInstance = instance
-						a.activeInstanceLock.Unlock()
-
-						if currentActive != nil {
-							currentActive.Stop()
-						}
-					}
-				}
+// terminated returns true if all instances exited and their hooks finished
+func (a *App) terminated() bool {
+	for _, instance := range a.instances {
+		if !instance.terminated() || instance.hooks > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// do runs fn in supervisor goroutine and waits for it to finish. After
+// supervisor stopped, app state does not change anymore and fn runs in
+// caller goroutine.
+func (a *App) do(fn func()) {
+	done := make(chan struct{})
+	select {
+	case a.actions <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-a.stopped:
+		a.stoppedLock.Lock()
+		fn()
+		a.stoppedLock.Unlock()
+	}
+}
+
+// post queues fn to run in supervisor without waiting for it, used by
+// timers. fn is dropped after supervisor stopped.
+func (a *App) post(fn func()) {
+	select {
+	case a.actions <- fn:
+	case <-a.stopped:
+	}
+}
+
+func (a *App) handleEvent(event *InstanceEvent) {
+	instance := event.instance
+	if event.event == InstanceEventPreStarted {
+		a.preStarted(instance, event.hookErr)
+		return
+	}
+	if event.event == InstanceEventCheckFailed {
+		if instance.status == InstanceStatusStarting {
+			a.progressf("Instance %d health check attempt %d failed: %s", instance.id, event.checkAttempt, event.checkErr)
+		}
+		return
+	}
+	if !instance.HandleEvent(event) {
+		return
+	}
+
+	if event.event == InstanceEventExited {
+		if a.shadow != nil && a.shadow.instance == instance {
+			a.endShadow()
+		}
+		a.portPool.ReleasePort(instance.internalPort)
+		a.recordHistory(instance)
+		a.closeRetiredLoggers()
+		defer a.pruneInstances()
+	}
+
+	switch instance.status {
+	case InstanceStatusServing:
+		if instance.unhealthy {
+			a.instanceUnhealthy(instance)
+		} else if instance.canary {
+			a.canaryServing(instance)
+		} else if instance.held {
+			a.heldServing(instance)
+		} else {
+			a.instanceServing(instance)
+		}
+	case InstanceStatusExited, InstanceStatusFailed, InstanceStatusTimedOut:
+		if instance.canary {
+			a.canaryFailed(instance)
+		} else if instance.held {
+			a.heldFailed(instance)
+		} else {
+			a.instanceFailed(instance)
+		}
+	}
+}
+
+// instanceServing switches traffic to new instance, after shadow phase if
+// configured
+func (a *App) instanceServing(instance *Instance) {
+	if a.startShadow(instance) {
+		return
+	}
+	a.switchTraffic(instance)
+}
+
+// switchTraffic switches traffic to new instance and stops the instance it
+// replaces, then continues with the rolling restart
+func (a *App) switchTraffic(instance *Instance) {
+	old := instance.replaces
+	instance.replaces = nil
+
+	a.addActive(instance)
+	a.progressf("Switched traffic to instance %d", instance.id)
+	if old != nil && old.active {
+		a.removeActive(old)
+		a.retire([]*Instance{old}, []*Instance{instance})
+	}
+
+	if err := a.scale(); err != nil {
+		log.Print(err)
+	}
+}
+
+// instanceUnhealthy starts a replacement for instance that failed liveness
+// probes, traffic is switched when the replacement is serving
+func (a *App) instanceUnhealthy(instance *Instance) {
+	if instance.canary {
+		a.canaryFailed(instance)
+		return
+	}
+	if !instance.active {
+		return
+	}
+
+	a.removeReplacing(instance)
+	for _, other := range a.instances {
+		if other.status == InstanceStatusStarting && other.replaces == instance {
+			return
+		}
+	}
+	if _, err := a.startNewInstance(instance); err != nil {
+		log.Print(err)
+		a.replacing = append([]*Instance{instance}, a.replacing...)
+		a.scheduleRestart()
+	}
+}
+
+func (a *App) instanceFailed(instance *Instance) {
+	if instance.preStartFailed {
+		a.preStartFailed(instance)
+		return
+	}
+	needed := false
+
+	if instance.active {
+		// serving instance crashed, it has to be replaced
+		a.removeActive(instance)
+		a.removeReplacing(instance)
+		for _, other := range a.instances {
+			if other.replaces == instance {
+				other.replaces = nil
 			}
+		}
+		needed = true
+	} else if instance.replaces != nil {
+		// retry replacement of the same instance
+		a.replacing = append([]*Instance{instance.replaces}, a.replacing...)
+		instance.replaces = nil
+		needed = true
+	} else {
+		needed = a.missingReplicas() > 0
+	}
+
+	if !needed {
+		return
+	}
+	if a.config.Restart == RestartNever {
+		return
+	}
+	if a.config.Restart == RestartOnFailure && !instance.exitedWithError() {
+		return
+	}
+	if instance.servedFor() >= time.Duration(a.config.Backoff.ResetAfter)*time.Second {
+		a.restartCount = 0
+	}
+	a.scheduleRestart()
+}
+
+// scheduleRestart scales the app after backoff delay or puts app into fatal
+// state when max retries are reached
+func (a *App) scheduleRestart() {
+	if a.restartTimer != nil {
+		return
+	}
+	if a.restartCount >= a.config.MaxRetries {
+		a.fatal = true
+		log.Printf("%s: Gave up restarting after %d retries", a.config.Name, a.restartCount)
+		return
+	}
+
+	a.restartCount++
+	delay := a.restartDelay()
+	log.Printf("%s: Restarting in %s (retry %d/%d)", a.config.Name, delay, a.restartCount, a.config.MaxRetries)
 
-			if lastStatus == InstanceStatusExited || lastStatus == InstanceStatusFailed || lastStatus == InstanceStatusTimedOut {
-				if restartCount < a.config.MaxRetries {
-					restartCount++
-					err := a.StartNewInstance()
-					if err != nil {
-						log.Print(err)
-					}
-				}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		a.post(func() {
+			if a.restartTimer != timer {
+				return
 			}
+			a.restartTimer = nil
+			if err := a.scale(); err != nil {
+				log.Print(err)
+				a.scheduleRestart()
+			}
+		})
+	})
+	a.restartTimer = timer
+}
+
+func (a *App) cancelRestart() {
+	if a.restartTimer != nil {
+		a.restartTimer.Stop()
+		a.restartTimer = nil
+	}
+}
+
+// restartDelay returns exponential backoff delay for current retry
+func (a *App) restartDelay() time.Duration {
+	backoff := a.config.Backoff
+	delay := float64(backoff.InitialDelay) * math.Pow(backoff.Multiplier, float64(a.restartCount-1))
+	if delay > float64(backoff.MaxDelay) {
+		delay = float64(backoff.MaxDelay)
+	}
+	return time.Duration(delay * float64(time.Second))
+}
 
-			<-ticker.C
+// missingReplicas returns number of instances that have to be started to
+// get to configured number of replicas
+func (a *App) missingReplicas() int {
+	missing := a.config.Replicas - len(a.activeInstances)
+	for _, instance := range a.instances {
+		if instance.status == InstanceStatusStarting && instance.replaces == nil && !instance.canary && !instance.held {
+			missing--
 		}
-	}()
+	}
+	return missing
+}
+
+// stopExtraReplicas stops active instances over configured number of
+// replicas, so only the remaining ones are replaced
+func (a *App) stopExtraReplicas() {
+	for len(a.activeInstances) > a.config.Replicas {
+		instance := a.activeInstances[len(a.activeInstances)-1]
+		a.removeActive(instance)
+		instance.Stop()
+	}
+}
+
+// scale starts missing replicas and replaces the next instance of rolling
+// restart. Only one instance is replaced at a time.
+func (a *App) scale() error {
+	for i := a.missingReplicas(); i > 0; i-- {
+		if _, err := a.startNewInstance(nil); err != nil {
+			return err
+		}
+	}
+
+	for _, instance := range a.instances {
+		if instance.status == InstanceStatusStarting && instance.replaces != nil {
+			return nil
+		}
+	}
+	if a.shadow != nil {
+		return nil
+	}
+
+	for len(a.replacing) > 0 {
+		old := a.replacing[0]
+		if !old.active {
+			a.replacing = a.replacing[1:]
+			continue
+		}
+		if _, err := a.startNewInstance(old); err != nil {
+			return err
+		}
+		a.replacing = a.replacing[1:]
+		break
+	}
+
+	return nil
+}
+
+func (a *App) removeReplacing(instance *Instance) {
+	replacing := a.replacing[:0]
+	for _, other := range a.replacing {
+		if other != instance {
+			replacing = append(replacing, other)
+		}
+	}
+	a.replacing = replacing
+}
+
+func (a *App) setActiveInstances(instances []*Instance) {
+	a.activeInstanceLock.Lock()
+	a.activeInstances = instances
+	a.activeInstanceLock.Unlock()
+}
+
+func (a *App) setCanaryInstances(instances []*Instance, weight int) {
+	a.activeInstanceLock.Lock()
+	a.canaryInstances = instances
+	a.canaryWeight = weight
+	a.activeInstanceLock.Unlock()
+}
+
+func (a *App) addActive(instance *Instance) {
+	instances := make([]*Instance, 0, len(a.activeInstances)+1)
+	instances = append(instances, a.activeInstances...)
+	instances = append(instances, instance)
+	instance.setActive(true)
+	a.setActiveInstances(instances)
+}
+
+func (a *App) removeActive(instance *Instance) {
+	instances := make([]*Instance, 0, len(a.activeInstances))
+	for _, other := range a.activeInstances {
+		if other != instance {
+			instances = append(instances, other)
+		}
+	}
+	instance.setActive(false)
+	a.setActiveInstances(instances)
 }
 
 // reserveInstance reserves active instance for an active http request
 func (a *App) reserveInstance() (*Instance, error) {
 	a.activeInstanceLock.RLock()
-	instance := a.activeInstance
+	instances := a.activeInstances
+	if len(a.canaryInstances) > 0 && (len(instances) == 0 || rand.Intn(100) < a.canaryWeight) {
+		instances = a.canaryInstances
+	}
 
-	if instance == nil {
+	if len(instances) == 0 {
 		a.activeInstanceLock.RUnlock()
 		return nil, ErrNoActiveInstances
 	}
 
+	instance := a.balancer.Pick(instances)
 	instance.Serve()
 	a.activeInstanceLock.RUnlock()
 
 	return instance, nil
 }
 
-func (a *App) StartNewInstance() error {
+// Restart replaces running instances one at a time and starts missing
+// replicas. If rollout is configured, traffic is shifted to a new set of
+// instances in steps instead.
+func (a *App) Restart() error {
+	_, err := a.StartRestart(false)
+	return err
+}
+
+// StartRestart restarts app or starts held instances and returns id of
+// restart progress
+func (a *App) StartRestart(hold bool) (uint32, error) {
+	var id uint32
+	var err error
+	a.do(func() {
+		id = a.startProgress(hold)
+		if hold {
+			err = a.hold()
+		} else {
+			err = a.restart()
+		}
+		if err != nil {
+			a.finishProgress(err.Error())
+		}
+	})
+	return id, err
+}
+
+func (a *App) restart() error {
+	if a.fatal {
+		return ErrAppFatal
+	}
+	a.cancelRestart()
+	if a.watch != nil {
+		a.endWatch(true)
+	}
+	if a.shadow != nil {
+		a.abortShadow()
+	}
+	a.stopExtraReplicas()
+	if a.config.Rollout != nil && len(a.activeInstances) > 0 {
+		a.replacing = nil
+		return a.startRollout()
+	}
+	a.replacing = append([]*Instance{}, a.activeInstances...)
+	if err := a.scale(); err != nil {
+		// abort restart, old instances keep serving
+		a.replacing = nil
+		return err
+	}
+	return nil
+}
+
+// Reset clears fatal state and retry counter and starts missing replicas
+func (a *App) Reset() error {
+	var err error
+	a.do(func() {
+		a.fatal = false
+		a.restartCount = 0
+		a.cancelRestart()
+		err = a.scale()
+	})
+	return err
+}
+
+func (a *App) startNewInstance(replaces *Instance) (*Instance, error) {
 	newInstance, err := NewInstance(a, atomic.AddUint32(&a.instanceId, 1))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	newInstance.replaces = replaces
 
 	a.instances = append(a.instances, newInstance)
-	return nil
+	a.trackInstance(newInstance)
+	return newInstance, nil
 }
 
 func (a *App) StopInstances(instanceId int, kill bool) error {
+	var err error
+	a.do(func() {
+		err = a.stopInstances(instanceId, kill)
+	})
+	return err
+}
+
+func (a *App) stopInstances(instanceId int, kill bool) error {
+	if instanceId <= 0 {
+		a.cancelRestart()
+		a.replacing = nil
+		if a.rollout != nil {
+			a.abortRollout()
+		}
+		if a.watch != nil {
+			a.endWatch(false)
+		}
+		if a.shadow != nil {
+			a.endShadow()
+		}
+		a.held = nil
+		if a.progress != nil && !a.progress.done {
+			a.finishProgress("Instances were stopped")
+		}
+	}
+
 	stopped := false
 	for _, instance := range a.instances {
 		if instanceId > 0 && int(instance.id) != instanceId {
@@ -150,6 +607,9 @@ func (a *App) StopInstances(instanceId int, kill bool) error {
 		}
 		if instance.status == InstanceStatusServing || instance.status == InstanceStatusStarting {
 			stopped = true
+			if instance.active {
+				a.removeActive(instance)
+			}
 			if kill {
 				instance.Kill()
 			} else {
@@ -163,35 +623,221 @@ func (a *App) StopInstances(instanceId int, kill bool) error {
 	return nil
 }
 
-func (a *App) ListenAndServe() error {
-	if err := a.StartNewInstance(); err != nil {
+// Start binds external listener, starts serving proxy on it and starts
+// app instances
+func (a *App) Start() error {
+	var err error
+	a.do(func() {
+		if err = a.listen(a.config); err != nil {
+			return
+		}
+		err = a.restart()
+	})
+	return err
+}
+
+// listen replaces app listener with a new one for config
+func (a *App) listen(config *AppConfig) error {
+	hostPort := fmt.Sprintf("%s:%d", config.ExternalHost, config.ExternalPort)
+
+	// new listener can only be bound before closing the old one when
+	// address changes
+	if a.listener != nil && hostPort == a.externalHostPort {
+		a.closeListener()
+	}
+
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
 		return err
 	}
+	if a.listener != nil {
+		a.closeListener()
+	}
+
+	a.externalHostPort = hostPort
+	a.serve(listener, config.Name, config.Proxy)
+	return nil
+}
+
+// serve starts proxy on listener, it runs until the listener is closed
+func (a *App) serve(listener net.Listener, name, proxy string) {
+	server := &http.Server{Handler: a.rp}
+	a.listener = listener
+	a.server = server
+
+	go func() {
+		var err error
+		if proxy == ProxyTypeTCP {
+			log.Printf("%s: Starting tcp proxy on %s", name, listener.Addr())
+			err = NewTcpProxy(a).Serve(listener)
+		} else {
+			log.Printf("%s: Starting http proxy on %s", name, listener.Addr())
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Printf("%s: Proxy error: %s", name, err)
+		}
+	}()
+}
+
+// closeListener stops accepting connections. Keep-alive connections of http
+// proxy are closed once their requests finish, so they do not take new
+// requests.
+func (a *App) closeListener() {
+	a.listener.Close()
+	a.listener = nil
+	go a.server.Shutdown(context.Background())
+}
+
+// Update switches app to new config. Running instances are replaced with
+// instances started with new config and listener is rebound if external
+// address or proxy type changed.
+func (a *App) Update(config *AppConfig) error {
+	var err error
+	a.do(func() {
+		err = a.update(config)
+	})
+	return err
+}
+
+func (a *App) update(config *AppConfig) error {
+	old := a.config
+
+	if a.listener != nil && (config.ExternalHost != old.ExternalHost ||
+		config.ExternalPort != old.ExternalPort || config.Proxy != old.Proxy) {
+		if err := a.listen(config); err != nil {
+			return err
+		}
+	}
+
+	if *config.Logger != *old.Logger {
+		a.retiredLoggers = append(a.retiredLoggers, a.appLogger)
+		a.appLogger = NewAppLogger(config)
+	}
+	a.activeInstanceLock.Lock()
+	if config.Balance != old.Balance {
+		a.balancer = NewBalancer(config.Balance)
+	}
+	a.debugRouting = config.DebugRouting
+	a.activeInstanceLock.Unlock()
+
+	if a.rollout != nil {
+		a.abortRollout()
+	}
+	if len(a.held) > 0 {
+		a.discardHeld()
+	}
+	if a.shadow != nil {
+		a.abortShadow()
+	}
+	a.config = config
+	a.fatal = false
+	a.restartCount = 0
 
-	if a.config.Proxy == ProxyTypeTCP {
-		log.Print("Starting tcp proxy")
-		return NewTcpProxy(a).ServeTcp()
+	// instances that are still starting run with old config
+	for _, instance := range a.instances {
+		if instance.status == InstanceStatusStarting {
+			instance.Stop()
+		}
 	}
-	log.Print("Starting http proxy")
-	return http.ListenAndServe(a.externalHostPort, a.rp)
+
+	// running instances are replaced one by one
+	a.startProgress(false)
+	return a.restart()
+}
+
+// Shutdown closes app listener and stops all instances after they finish
+// serving their connections. Supervisor stops when all instances exited.
+func (a *App) Shutdown() {
+	a.do(func() {
+		a.shutdown = true
+		if a.listener != nil {
+			a.closeListener()
+		}
+		if err := a.stopInstances(-1, false); err != nil && err != ErrInstanceNotRunning {
+			log.Print(a.config.Name, ": ", err)
+		}
+	})
+}
+
+// Config returns config app is running with
+func (a *App) Config() *AppConfig {
+	var config *AppConfig
+	a.do(func() {
+		config = a.config
+	})
+	return config
+}
+
+// Groups returns groups app belongs to
+func (a *App) Groups() []string {
+	var groups []string
+	a.do(func() {
+		groups = a.config.Groups
+	})
+	return groups
 }
 
 // Report returns report for rpc status commands
 func (a *App) Report(displayN int) *report.App {
+	var appReport *report.App
+	a.do(func() {
+		appReport = a.report(displayN)
+	})
+	return appReport
+}
+
+func (a *App) status() string {
+	if a.fatal {
+		return AppStatusFatal
+	}
+	if a.restartTimer != nil {
+		return AppStatusBackoff
+	}
+	if len(a.activeInstances) > 0 {
+		return AppStatusRunning
+	}
+	for _, instance := range a.instances {
+		if instance.status == InstanceStatusStarting {
+			return AppStatusStarting
+		}
+	}
+	return AppStatusStopped
+}
+
+func (a *App) report(displayN int) *report.App {
 	appReport := &report.App{
-		Name: a.config.Name,
-		Host: a.config.ExternalHost,
-		Port: a.config.ExternalPort,
+		Name:     a.config.Name,
+		Host:     a.config.ExternalHost,
+		Port:     a.config.ExternalPort,
+		Status:   a.status(),
+		Restarts: a.restartCount,
 	}
 
-	from := 0
-	if len(a.instances) > displayN {
-		from = len(a.instances) - displayN
+	if a.rollout != nil {
+		appReport.Rollout = a.rollout.Report(len(a.config.Rollout.Steps))
+	}
+	if a.watch != nil {
+		window := time.Duration(a.config.Rollback.Window) * time.Second
+		appReport.WatchLeft = uint64((window - time.Since(a.watch.start)) / time.Second)
+	}
+	appReport.Rollback = a.lastRollback
+	if a.shadow != nil {
+		appReport.Shadow = a.shadow.Report(true)
+	} else {
+		appReport.Shadow = a.lastShadow
 	}
 
-	sort.Stable(InstanceStatusSort(a.instances))
+	instances := make([]*Instance, len(a.instances))
+	copy(instances, a.instances)
+	sort.Stable(InstanceStatusSort(instances))
+
+	from := 0
+	if len(instances) > displayN {
+		from = len(instances) - displayN
+	}
 
-	for _, instance := range a.instances[from:len(a.instances)] {
+	for _, instance := range instances[from:] {
 		instanceReport := instance.Report()
 		appReport.Instances = append(appReport.Instances, instanceReport)
 	}
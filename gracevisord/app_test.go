@@ -0,0 +1,474 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestApp(t *testing.T, appConfig *AppConfig) *App {
+	logDir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Logger: &LoggerConfig{
+			LogDir: logDir,
+		},
+	}
+
+	if appConfig.Name == "" {
+		appConfig.Name = "test"
+	}
+	if len(appConfig.Environment) == 0 {
+		appConfig.Environment = []string{"PORT={port}"}
+	}
+	if err := appConfig.clean(config); err != nil {
+		t.Fatal("App config clean failed:", err)
+	}
+
+	app := NewApp(appConfig, NewPortPool(20000, 21000))
+	t.Cleanup(func() {
+		app.StopInstances(-1, true)
+		os.RemoveAll(logDir)
+	})
+	return app
+}
+
+// waitFor polls app state in supervisor until cond returns true
+func waitFor(t *testing.T, app *App, msg string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ok := false
+		app.do(func() {
+			ok = cond()
+		})
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for:", msg)
+}
+
+func TestAppRestart(t *testing.T) {
+	app := newTestApp(t, &AppConfig{Command: "sleep 30"})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1 && app.activeInstances[0].id == 1
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "second instance active", func() bool {
+		return len(app.activeInstances) == 1 && app.activeInstances[0].id == 2
+	})
+	waitFor(t, app, "first instance stopped", func() bool {
+		return app.instances[0].status == InstanceStatusStopped
+	})
+
+	instance, err := app.reserveInstance()
+	if err != nil {
+		t.Fatal("No instance reserved:", err)
+	}
+	instance.Done()
+	if instance.id != 2 {
+		t.Error("Reserved instance should be the active one:", instance.id)
+	}
+}
+
+func TestAppScaleDown(t *testing.T) {
+	config := &AppConfig{
+		Command:  "sleep 30",
+		Replicas: 3,
+	}
+	app := newTestApp(t, config)
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "all replicas active", func() bool {
+		return len(app.activeInstances) == 3
+	})
+
+	newConfig := *config
+	newConfig.Replicas = 1
+	if err := app.Update(&newConfig); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+	waitFor(t, app, "single replica replaced", func() bool {
+		return len(app.activeInstances) == 1 && app.activeInstances[0].id == 4
+	})
+	waitFor(t, app, "old replicas stopped", func() bool {
+		for _, instance := range app.instances {
+			if instance.id != 4 && !instance.terminated() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestAppRollingRestart(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:  "sleep 30",
+		Replicas: 3,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "all replicas active", func() bool {
+		return len(app.activeInstances) == 3
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	minActive := 3
+	maxStarting := 0
+	waitFor(t, app, "all replicas replaced", func() bool {
+		if len(app.activeInstances) < minActive {
+			minActive = len(app.activeInstances)
+		}
+		starting := 0
+		for _, instance := range app.instances {
+			if instance.status == InstanceStatusStarting {
+				starting++
+			}
+		}
+		if starting > maxStarting {
+			maxStarting = starting
+		}
+		for _, instance := range app.activeInstances {
+			if instance.id <= 3 {
+				return false
+			}
+		}
+		return len(app.activeInstances) == 3
+	})
+	if minActive < 2 {
+		t.Error("Active replicas dropped below N-1 during restart:", minActive)
+	}
+	if maxStarting > 1 {
+		t.Error("Rolling restart should replace one instance at a time:", maxStarting)
+	}
+
+	waitFor(t, app, "old replicas stopped", func() bool {
+		for _, instance := range app.instances[:3] {
+			if instance.status != InstanceStatusStopped {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestAppMaxRetries(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:     "false",
+		HealthCheck: &HealthCheckConfig{Path: "/"},
+		MaxRetries:  2,
+		Backoff:     &BackoffConfig{Multiplier: 1},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "app fatal", func() bool {
+		return app.fatal
+	})
+
+	app.do(func() {
+		if len(app.instances) != 3 {
+			t.Error("App should stop restarting after max retries:", len(app.instances))
+		}
+		if app.status() != AppStatusFatal {
+			t.Error("Incorrect app status:", app.status())
+		}
+	})
+
+	if _, err := app.reserveInstance(); err != ErrNoActiveInstances {
+		t.Error("Failed app should have no active instance")
+	}
+
+	if app.Restart() != ErrAppFatal {
+		t.Error("Fatal app should not start before reset")
+	}
+
+	if err := app.Reset(); err != nil {
+		t.Fatal("Reset failed:", err)
+	}
+	app.do(func() {
+		if app.fatal {
+			t.Error("Reset should clear fatal state")
+		}
+		if len(app.instances) != 4 {
+			t.Error("Reset should start a new instance")
+		}
+	})
+}
+
+func TestAppRestartOnFailure(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 0.2",
+		Restart: RestartOnFailure,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance exited", func() bool {
+		return app.instances[0].status == InstanceStatusExited
+	})
+
+	app.do(func() {
+		if app.restartTimer != nil || len(app.instances) != 1 {
+			t.Error("Clean exit should not be restarted with on-failure policy")
+		}
+		if app.status() != AppStatusStopped {
+			t.Error("Incorrect app status:", app.status())
+		}
+	})
+}
+
+func TestAppRestartDelay(t *testing.T) {
+	app := &App{
+		config: &AppConfig{
+			Backoff: &BackoffConfig{
+				InitialDelay: 1,
+				Multiplier:   2,
+				MaxDelay:     5,
+			},
+		},
+	}
+
+	for retry, delay := range []int{1, 2, 4, 5, 5} {
+		app.restartCount = retry + 1
+		if app.restartDelay() != time.Duration(delay)*time.Second {
+			t.Error("Incorrect restart delay for retry", app.restartCount, app.restartDelay())
+		}
+	}
+}
+
+func TestAppStopTimeout(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:        "sleep 30",
+		StopSignalName: "CONT",
+		StopTimeout:    1,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance killed", func() bool {
+		return app.instances[0].status == InstanceStatusKilled
+	})
+}
+
+func TestAppStopSequence(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		StopSequence: []*StopStepConfig{
+			{SignalName: "CONT", Timeout: 1},
+			{SignalName: "INT"},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "first stop step", func() bool {
+		report := app.instances[0].Report()
+		return report.StopStep == 1 && report.StopSteps == 2 && report.StopSignal == "CONT"
+	})
+	waitFor(t, app, "instance stopped by second step", func() bool {
+		return app.instances[0].status == InstanceStatusStopped && app.instances[0].stopStep == 2
+	})
+}
+
+func TestAppDrainTimeout(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:      "sleep 30",
+		DrainTimeout: 1,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	// hung connection that only finishes when force closed
+	instance := app.activeInstances[0]
+	closed := make(chan struct{})
+	instance.Serve()
+	instance.Track(func() {
+		close(closed)
+		instance.Done()
+	})
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance draining", func() bool {
+		report := instance.Report()
+		return report.Status == "stopping" && report.InFlight == 1 && report.StopStep == 0
+	})
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection was not closed after drain timeout")
+	}
+	waitFor(t, app, "instance stopped", func() bool {
+		return instance.status == InstanceStatusStopped && instance.Conns() == 0
+	})
+}
+
+func TestAppShutdown(t *testing.T) {
+	app := newTestApp(t, &AppConfig{Command: "sleep 30"})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	// replaced logger is closed when its instances are gone
+	config := *app.Config()
+	logger := *config.Logger
+	logger.MaxLogSize++
+	config.Logger = &logger
+	if err := app.Update(&config); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+	waitFor(t, app, "old instance stopped", func() bool {
+		return app.instances[0].terminated() && len(app.activeInstances) == 1
+	})
+	app.do(func() {
+		if len(app.retiredLoggers) != 0 {
+			t.Error("Logger of old instance should be closed")
+		}
+	})
+
+	app.Shutdown()
+	select {
+	case <-app.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Supervisor should stop after instances exited")
+	}
+	if report := app.Report(1); report == nil || len(report.Instances) == 0 {
+		t.Error("Stopped app should still report its state")
+	}
+}
+
+func TestAppStopRepeated(t *testing.T) {
+	script := writeTestScript(t, "trap 'echo stop >> $0.out' CONT\necho ready\nwhile true; do sleep 0.1; done\n")
+	app := newTestApp(t, &AppConfig{
+		Command:        script,
+		ReadyPattern:   "ready",
+		StopSignalName: "CONT",
+		StopTimeout:    2,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	stops := func() int {
+		data, _ := ioutil.ReadFile(script + ".out")
+		return strings.Count(string(data), "stop")
+	}
+	waitFor(t, app, "stop signal", func() bool {
+		return stops() == 1
+	})
+	stopped := time.Now()
+
+	// stopping instance is drained again and receives signal again
+	time.Sleep(time.Second)
+	app.do(func() {
+		app.instances[0].Stop()
+	})
+	waitFor(t, app, "repeated stop signal", func() bool {
+		return stops() == 2 && app.instances[0].stopStep == 1
+	})
+
+	// stop timeout of the first signal is ignored
+	time.Sleep(time.Until(stopped.Add(2500 * time.Millisecond)))
+	var status int
+	app.do(func() {
+		status = app.instances[0].status
+	})
+	if status != InstanceStatusStopping {
+		t.Error("Stop timeout of resent signal should restart:", status)
+	}
+	waitFor(t, app, "instance killed", func() bool {
+		return app.instances[0].status == InstanceStatusKilled
+	})
+}
+
+func TestAppStopNoTimeout(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:        "sleep 30",
+		StopSignalName: "CONT",
+		StopTimeout:    0,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "stop signal", func() bool {
+		return app.instances[0].stopStep == 1
+	})
+
+	// without stop timeout instance is never killed
+	time.Sleep(1500 * time.Millisecond)
+	var status int
+	app.do(func() {
+		status = app.instances[0].status
+		app.instances[0].Kill()
+	})
+	if status != InstanceStatusStopping {
+		t.Error("Instance should keep stopping without stop timeout:", status)
+	}
+	waitFor(t, app, "instance killed", func() bool {
+		return app.instances[0].status == InstanceStatusKilled
+	})
+}
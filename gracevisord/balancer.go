@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancer picks an instance from a non empty set of serving instances
+type Balancer interface {
+	Pick(instances []*Instance) *Instance
+}
+
+func NewBalancer(balance string) Balancer {
+	switch balance {
+	case BalanceLeastConn:
+		return &LeastConnBalancer{}
+	case BalanceP2C:
+		return &P2CBalancer{}
+	}
+	return &RoundRobinBalancer{}
+}
+
+type RoundRobinBalancer struct {
+	next uint32
+}
+
+func (b *RoundRobinBalancer) Pick(instances []*Instance) *Instance {
+	n := atomic.AddUint32(&b.next, 1)
+	return instances[int(n%uint32(len(instances)))]
+}
+
+type LeastConnBalancer struct{}
+
+func (b *LeastConnBalancer) Pick(instances []*Instance) *Instance {
+	best := instances[0]
+	for _, instance := range instances[1:] {
+		if instance.Conns() < best.Conns() {
+			best = instance
+		}
+	}
+	return best
+}
+
+// P2CBalancer picks two random instances and uses the less loaded one
+type P2CBalancer struct{}
+
+func (b *P2CBalancer) Pick(instances []*Instance) *Instance {
+	if len(instances) == 1 {
+		return instances[0]
+	}
+
+	i := rand.Intn(len(instances))
+	j := rand.Intn(len(instances) - 1)
+	if j >= i {
+		j++
+	}
+
+	if instances[j].Conns() < instances[i].Conns() {
+		return instances[j]
+	}
+	return instances[i]
+}
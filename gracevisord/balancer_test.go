@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func testInstances(conns ...int64) []*Instance {
+	instances := []*Instance{}
+	for i, c := range conns {
+		instances = append(instances, &Instance{id: uint32(i + 1), conns: c})
+	}
+	return instances
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	instances := testInstances(0, 0, 0)
+	balancer := NewBalancer(BalanceRoundRobin)
+
+	picked := map[uint32]int{}
+	for i := 0; i < 30; i++ {
+		picked[balancer.Pick(instances).id]++
+	}
+	for _, instance := range instances {
+		if picked[instance.id] != 10 {
+			t.Error("Round robin should pick instances evenly:", picked)
+		}
+	}
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	instances := testInstances(5, 1, 3)
+	balancer := NewBalancer(BalanceLeastConn)
+
+	if balancer.Pick(instances).id != 2 {
+		t.Error("Least conn should pick instance with least connections")
+	}
+}
+
+func TestP2CBalancer(t *testing.T) {
+	instances := testInstances(1, 0)
+	balancer := NewBalancer(BalanceP2C)
+
+	for i := 0; i < 10; i++ {
+		if balancer.Pick(instances).id != 2 {
+			t.Error("P2C should pick less loaded of two instances")
+		}
+	}
+
+	instances = testInstances(100, 0, 0, 0)
+	for i := 0; i < 100; i++ {
+		if balancer.Pick(instances).id == 1 {
+			t.Error("P2C should never pick the most loaded instance")
+		}
+	}
+}
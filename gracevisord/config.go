@@ -4,23 +4,54 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/user"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/hamaxx/gracevisor/deps/yaml.v2"
 )
 
 var (
 	ErrInvalidPortRange  = errors.New("Invalid port range")
+	ErrPortRangeOutside  = errors.New("App port range must be inside global port range")
 	ErrNameRequired      = errors.New("Name must be specified for app")
+	ErrInvalidName       = errors.New("App name must not contain / or ..")
 	ErrCommandRequired   = errors.New("Command must be specified for app")
 	ErrPortBadgeRequired = errors.New("App must have {port} in command or environment")
 	ErrInvalidStopSignal = errors.New("Invalid stop signal")
+	ErrStopSequence      = errors.New("Use either stop_sequence or stop_signal with stop_timeout")
+	ErrStopStepTimeout   = errors.New("Stop sequence steps must have timeout, except the last one")
+	ErrStopTimeout       = errors.New("Invalid stop timeout")
+	ErrInvalidDrain      = errors.New("Invalid drain timeout")
 	ErrInvalidUserId     = errors.New("Invalid user id format")
 	ErrInvalidProxyType  = errors.New("Invalid proxy type (tcp/http)")
+	ErrInvalidRestart    = errors.New("Invalid restart policy (always/on-failure/never)")
+	ErrInvalidBackoff    = errors.New("Invalid backoff (multiplier must be at least 1)")
+	ErrInvalidReplicas   = errors.New("Invalid number of replicas")
+	ErrInvalidHistory    = errors.New("Invalid history length")
+	ErrInvalidKeepExited = errors.New("Invalid number of kept exited instances")
+	ErrInvalidBalance    = errors.New("Invalid balance (round-robin/least-conn/p2c)")
+	ErrRolloutSteps      = errors.New("Rollout must have at least one step")
+	ErrInvalidWeight     = errors.New("Invalid rollout weight (1-100)")
+	ErrInvalidThreshold  = errors.New("Invalid rollback threshold (0-100)")
+	ErrLivenessCheck     = errors.New("Liveness probes require healthcheck")
+	ErrMaxProxyErrors    = errors.New("Invalid number of max proxy errors")
+	ErrInvalidCheckType  = errors.New("Invalid healthcheck type (http/tcp/exec)")
+	ErrCheckCommand      = errors.New("Exec healthcheck requires command")
+	ErrLifecycleHook     = errors.New("Lifecycle hook requires either signal or path")
+	ErrInvalidHookSignal = errors.New("Invalid lifecycle hook signal")
+	ErrHookCommand       = errors.New("Hook requires command")
+	ErrInvalidWarmup     = errors.New("Invalid warmup (repeat and concurrency must be positive)")
+	ErrInvalidAllowedIP  = errors.New("Invalid debug routing allowed ip")
+	ErrShadowPercent     = errors.New("Invalid shadow percent (1-100)")
+	ErrShadowMethod      = errors.New("Shadow methods must be idempotent (GET/HEAD/OPTIONS/PUT/DELETE)")
+	ErrShadowProxy       = errors.New("Shadow requires http proxy")
+	ErrInvalidGroup      = errors.New("Invalid app group name")
 )
 
 const (
@@ -28,6 +59,24 @@ const (
 	ProxyTypeTCP  = "tcp"
 )
 
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckExec = "exec"
+)
+
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+	BalanceP2C        = "p2c"
+)
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
 const (
 	configFile = "gracevisor.yaml"
 
@@ -40,14 +89,61 @@ const (
 
 	defaultStopSignal = "TERM"
 	defaultMaxRetries = 5
-
-	defaultLogFileName = "gracevisor.log"
-	defaultLogDir      = "/var/log/gracevisor"
-	defaultMaxLogSize  = 500
-	defaultLogFileMode = os.FileMode(0600)
-	defaultLogDirMode  = os.FileMode(0744)
+	defaultHistory    = 100
+	defaultKeepExited = 5
+
+	defaultRestart             = RestartAlways
+	defaultBackoffInitialDelay = 1
+	defaultBackoffMultiplier   = 2
+	defaultBackoffMaxDelay     = 60
+	defaultBackoffResetAfter   = 60
+
+	defaultLogFileName    = "gracevisor.log"
+	defaultLogDir         = "/var/log/gracevisor"
+	defaultMaxLogSize     = 500
+	defaultLogFileMode    = os.FileMode(0600)
+	defaultConfigFileMode = os.FileMode(0644)
+	defaultLogDirMode     = os.FileMode(0744)
 
 	defaultProxyType = ProxyTypeHTTP
+
+	defaultShadowPercent  = 10
+	defaultShadowDuration = 60
+	defaultShadowMaxBody  = 64 << 10
+	defaultShadowTimeout  = 10
+
+	defaultRollbackWindow      = 60
+	defaultRollbackThreshold   = 5
+	defaultRollbackMinRequests = 20
+
+	defaultHealthCheckPath        = "/"
+	defaultHealthCheckMethod      = "GET"
+	defaultHealthCheckStatus      = 200
+	defaultHTTPHealthCheckTimeout = 1
+	defaultTCPHealthCheckTimeout  = 1
+	defaultExecHealthCheckTimeout = 10
+
+	defaultHookTimeout = 60
+
+	defaultWarmupMethod      = "GET"
+	defaultWarmupPath        = "/"
+	defaultWarmupRepeat      = 1
+	defaultWarmupConcurrency = 1
+	defaultWarmupTimeout     = 10
+
+	defaultLifecycleHookMethod  = "POST"
+	defaultLifecycleHookTimeout = 5
+
+	defaultLivenessInterval         = 10
+	defaultLivenessFailureThreshold = 3
+	defaultLivenessSuccessThreshold = 1
+
+	defaultDebugHeader         = "X-Gracevisor-Instance"
+	defaultDebugCookie         = "gracevisor_instance"
+	defaultDebugResponseHeader = "X-Gracevisor-Instance"
+
+	defaultReplicas = 1
+	defaultBalance  = BalanceRoundRobin
 )
 
 type UserConfig struct {
@@ -95,54 +191,563 @@ func (c *InternalPortsConfig) clean(g *Config) error {
 	return nil
 }
 
+type StopStepConfig struct {
+	SignalName string `yaml:"signal"`
+	Timeout    int    `yaml:"timeout"`
+
+	Signal syscall.Signal
+}
+
+func (c *StopStepConfig) clean(g *Config) error {
+	signal, ok := Signals[c.SignalName]
+	if !ok {
+		return ErrInvalidStopSignal
+	}
+	c.Signal = signal
+	if c.Timeout < 0 {
+		return ErrStopTimeout
+	}
+	return nil
+}
+
+type BackoffConfig struct {
+	InitialDelay int     `yaml:"initial_delay"`
+	Multiplier   float64 `yaml:"multiplier"`
+	MaxDelay     int     `yaml:"max_delay"`
+	ResetAfter   int     `yaml:"reset_after"`
+}
+
+func (c *BackoffConfig) clean(g *Config) error {
+	if c.InitialDelay <= 0 {
+		c.InitialDelay = defaultBackoffInitialDelay
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = defaultBackoffMultiplier
+	}
+	if c.Multiplier < 1 {
+		return ErrInvalidBackoff
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultBackoffMaxDelay
+	}
+	if c.MaxDelay < c.InitialDelay {
+		c.MaxDelay = c.InitialDelay
+	}
+	if c.ResetAfter <= 0 {
+		c.ResetAfter = defaultBackoffResetAfter
+	}
+
+	return nil
+}
+
+type RolloutStepConfig struct {
+	Weight   int `yaml:"weight"`
+	Duration int `yaml:"duration"`
+}
+
+type RolloutConfig struct {
+	Steps []*RolloutStepConfig `yaml:"steps"`
+}
+
+func (c *RolloutConfig) clean(g *Config) error {
+	if len(c.Steps) == 0 {
+		return ErrRolloutSteps
+	}
+
+	for _, step := range c.Steps {
+		if step.Weight <= 0 || step.Weight > 100 {
+			return ErrInvalidWeight
+		}
+		if step.Duration < 0 {
+			step.Duration = 0
+		}
+	}
+
+	return nil
+}
+
+type RollbackConfig struct {
+	Window      int     `yaml:"window"`
+	Threshold   float64 `yaml:"threshold"`
+	MinRequests int     `yaml:"min_requests"`
+}
+
+func (c *RollbackConfig) clean(g *Config) error {
+	if c.Window <= 0 {
+		c.Window = defaultRollbackWindow
+	}
+	if c.Threshold == 0 {
+		c.Threshold = defaultRollbackThreshold
+	}
+	if c.Threshold < 0 || c.Threshold > 100 {
+		return ErrInvalidThreshold
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultRollbackMinRequests
+	}
+
+	return nil
+}
+
+type HealthCheckConfig struct {
+	Type    string `yaml:"type"`
+	Timeout int    `yaml:"timeout"`
+
+	// http
+	Path    string            `yaml:"path"`
+	Method  string            `yaml:"method"`
+	Host    string            `yaml:"host"`
+	Headers map[string]string `yaml:"headers"`
+	Status  []int             `yaml:"status"`
+	Body    string            `yaml:"body"`
+
+	// exec
+	Command string `yaml:"command"`
+}
+
+// UnmarshalYAML also accepts http path as healthcheck
+func (c *HealthCheckConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		c.Type = HealthCheckHTTP
+		c.Path = path
+		return nil
+	}
+
+	type healthCheckConfig HealthCheckConfig
+	return unmarshal((*healthCheckConfig)(c))
+}
+
+func (c *HealthCheckConfig) clean(g *Config) error {
+	if c.Type == "" {
+		c.Type = HealthCheckHTTP
+	}
+
+	switch c.Type {
+	case HealthCheckHTTP:
+		if c.Path == "" {
+			c.Path = defaultHealthCheckPath
+		}
+		if c.Method == "" {
+			c.Method = defaultHealthCheckMethod
+		}
+		if len(c.Status) == 0 {
+			c.Status = []int{defaultHealthCheckStatus}
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = defaultHTTPHealthCheckTimeout
+		}
+	case HealthCheckTCP:
+		if c.Timeout <= 0 {
+			c.Timeout = defaultTCPHealthCheckTimeout
+		}
+	case HealthCheckExec:
+		if c.Command == "" {
+			return ErrCheckCommand
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = defaultExecHealthCheckTimeout
+		}
+	default:
+		return ErrInvalidCheckType
+	}
+
+	return nil
+}
+
+// WarmupConfig is http request replayed against new instance before it
+// receives traffic
+type WarmupConfig struct {
+	Method      string            `yaml:"method"`
+	Path        string            `yaml:"path"`
+	Headers     map[string]string `yaml:"headers"`
+	Repeat      int               `yaml:"repeat"`
+	Concurrency int               `yaml:"concurrency"`
+	Timeout     int               `yaml:"timeout"`
+}
+
+func (c *WarmupConfig) clean(g *Config) error {
+	if c.Method == "" {
+		c.Method = defaultWarmupMethod
+	}
+	if c.Path == "" {
+		c.Path = defaultWarmupPath
+	}
+	if c.Repeat == 0 {
+		c.Repeat = defaultWarmupRepeat
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = defaultWarmupConcurrency
+	}
+	if c.Repeat < 0 || c.Concurrency < 0 {
+		return ErrInvalidWarmup
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultWarmupTimeout
+	}
+	return nil
+}
+
+type LivenessConfig struct {
+	Interval         int `yaml:"interval"`
+	Timeout          int `yaml:"timeout"`
+	FailureThreshold int `yaml:"failure_threshold"`
+	SuccessThreshold int `yaml:"success_threshold"`
+}
+
+func (c *LivenessConfig) clean(g *Config) error {
+	if c.Interval <= 0 {
+		c.Interval = defaultLivenessInterval
+	}
+	if c.Timeout < 0 {
+		c.Timeout = 0
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = defaultLivenessFailureThreshold
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = defaultLivenessSuccessThreshold
+	}
+
+	return nil
+}
+
+// ShadowConfig enables shadow phase of restart, copies of live requests are
+// replayed to new instance before traffic is switched to it
+type ShadowConfig struct {
+	Percent  int      `yaml:"percent"`
+	Duration int      `yaml:"duration"`
+	Methods  []string `yaml:"methods"`
+	MaxBody  int64    `yaml:"max_body"`
+	Timeout  int      `yaml:"timeout"`
+}
+
+func (c *ShadowConfig) clean(g *Config) error {
+	if c.Percent == 0 {
+		c.Percent = defaultShadowPercent
+	}
+	if c.Percent < 1 || c.Percent > 100 {
+		return ErrShadowPercent
+	}
+	if c.Duration <= 0 {
+		c.Duration = defaultShadowDuration
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD", "OPTIONS"}
+	}
+	for i, method := range c.Methods {
+		method = strings.ToUpper(method)
+		switch method {
+		case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		default:
+			return ErrShadowMethod
+		}
+		c.Methods[i] = method
+	}
+	if c.MaxBody <= 0 {
+		c.MaxBody = defaultShadowMaxBody
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultShadowTimeout
+	}
+	return nil
+}
+
+// DebugRoutingConfig lets requests from allowed ips choose instance they
+// are routed to with header or cookie
+type DebugRoutingConfig struct {
+	Header         string   `yaml:"header"`
+	Cookie         string   `yaml:"cookie"`
+	AllowedIPs     []string `yaml:"allowed_ips"`
+	ResponseHeader string   `yaml:"response_header"`
+
+	allowedNets []*net.IPNet
+}
+
+func (c *DebugRoutingConfig) clean(g *Config) error {
+	if c.Header == "" {
+		c.Header = defaultDebugHeader
+	}
+	if c.Cookie == "" {
+		c.Cookie = defaultDebugCookie
+	}
+	if c.ResponseHeader == "" {
+		c.ResponseHeader = defaultDebugResponseHeader
+	}
+	if len(c.AllowedIPs) == 0 {
+		c.AllowedIPs = []string{"127.0.0.1", "::1"}
+	}
+
+	c.allowedNets = nil
+	for _, allowed := range c.AllowedIPs {
+		if !strings.Contains(allowed, "/") {
+			if ip := net.ParseIP(allowed); ip != nil && ip.To4() != nil {
+				allowed += "/32"
+			} else {
+				allowed += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(allowed)
+		if err != nil {
+			return ErrInvalidAllowedIP
+		}
+		c.allowedNets = append(c.allowedNets, ipNet)
+	}
+
+	return nil
+}
+
+// HooksConfig holds commands run by gracevisord before and after instance
+// starts and stops
+type HooksConfig struct {
+	PreStart  *HookConfig `yaml:"pre_start"`
+	PostStart *HookConfig `yaml:"post_start"`
+	PreStop   *HookConfig `yaml:"pre_stop"`
+	PostStop  *HookConfig `yaml:"post_stop"`
+}
+
+func (c *HooksConfig) clean(g *Config) error {
+	for _, hook := range []*HookConfig{c.PreStart, c.PostStart, c.PreStop, c.PostStop} {
+		if hook == nil {
+			continue
+		}
+		if err := hook.clean(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type HookConfig struct {
+	Command string `yaml:"command"`
+	Timeout int    `yaml:"timeout"`
+}
+
+// UnmarshalYAML also accepts command as hook
+func (c *HookConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		c.Command = command
+		return nil
+	}
+
+	type hookConfig HookConfig
+	return unmarshal((*hookConfig)(c))
+}
+
+func (c *HookConfig) clean(g *Config) error {
+	if c.Command == "" {
+		return ErrHookCommand
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultHookTimeout
+	}
+	return nil
+}
+
+// LifecycleConfig holds hooks called when instance becomes active, when its
+// traffic is removed and when draining is complete
+type LifecycleConfig struct {
+	Active   *LifecycleHookConfig `yaml:"active"`
+	Inactive *LifecycleHookConfig `yaml:"inactive"`
+	Drained  *LifecycleHookConfig `yaml:"drained"`
+}
+
+func (c *LifecycleConfig) clean(g *Config) error {
+	for _, hook := range []*LifecycleHookConfig{c.Active, c.Inactive, c.Drained} {
+		if hook == nil {
+			continue
+		}
+		if err := hook.clean(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LifecycleHookConfig is either a signal sent to instance or http request
+// to path on instance internal port
+type LifecycleHookConfig struct {
+	SignalName string `yaml:"signal"`
+	Path       string `yaml:"path"`
+	Method     string `yaml:"method"`
+	Timeout    int    `yaml:"timeout"`
+
+	Signal syscall.Signal
+}
+
+func (c *LifecycleHookConfig) clean(g *Config) error {
+	if (c.SignalName == "") == (c.Path == "") {
+		return ErrLifecycleHook
+	}
+
+	if c.SignalName != "" {
+		signal, ok := Signals[c.SignalName]
+		if !ok {
+			return ErrInvalidHookSignal
+		}
+		c.Signal = signal
+		return nil
+	}
+
+	if c.Method == "" {
+		c.Method = defaultLifecycleHookMethod
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultLifecycleHookTimeout
+	}
+	return nil
+}
+
 type AppConfig struct {
 	Name        string   `yaml:"name"`
+	Groups      []string `yaml:"groups"`
 	Command     string   `yaml:"command"`
 	Environment []string `yaml:"environment"`
 	Directory   string   `yaml:"directory"`
-	HealthCheck string   `yaml:"healthcheck"`
 
-	StopSignal     os.Signal
+	HealthCheck *HealthCheckConfig `yaml:"healthcheck"`
+
+	Notify       bool   `yaml:"notify"`
+	ReadyPattern string `yaml:"ready_pattern"`
+	readyPattern *regexp.Regexp
+
+	Warmup         []*WarmupConfig `yaml:"warmup"`
+	Liveness       *LivenessConfig `yaml:"liveness"`
+	MaxProxyErrors int             `yaml:"max_proxy_errors"`
+
+	Hooks     *HooksConfig     `yaml:"hooks"`
+	Lifecycle *LifecycleConfig `yaml:"lifecycle"`
+
+	StopSignal     syscall.Signal
 	StopSignalName string `yaml:"stop_signal"`
 	MaxRetries     int    `yaml:"max_retries"`
+	Restart        string `yaml:"restart"`
+	History        int    `yaml:"history"`
+	KeepExited     int    `yaml:"keep_exited"`
 	StartTimeout   int    `yaml:"start_timeout"`
 	StopTimeout    int    `yaml:"stop_timeout"`
+	DrainTimeout   int    `yaml:"drain_timeout"`
+
+	// StopSequence is a list of signals sent one after another when
+	// instance does not exit in step timeout, stopSequence is either
+	// StopSequence or a single step made of StopSignal and StopTimeout
+	StopSequence []*StopStepConfig `yaml:"stop_sequence"`
+	stopSequence []*StopStepConfig
 
-	InternalHost string `yaml:"internal_host"`
-	ExternalHost string `yaml:"external_host"`
-	ExternalPort uint16 `yaml:"external_port"`
+	InternalHost string               `yaml:"internal_host"`
+	PortRange    *InternalPortsConfig `yaml:"port_range"`
+	ExternalHost string               `yaml:"external_host"`
+	ExternalPort uint16               `yaml:"external_port"`
 
 	Logger *LoggerConfig `yaml:"logger"`
 	User   *UserConfig   `yaml:"user"`
 
 	Proxy string `yaml:"proxy"`
+
+	Replicas int    `yaml:"replicas"`
+	Balance  string `yaml:"balance"`
+
+	DebugRouting *DebugRoutingConfig `yaml:"debug_routing"`
+
+	Backoff  *BackoffConfig  `yaml:"backoff"`
+	Rollout  *RolloutConfig  `yaml:"rollout"`
+	Rollback *RollbackConfig `yaml:"rollback"`
+	Shadow   *ShadowConfig   `yaml:"shadow"`
+
+	// source is the config file app was defined in
+	source string
+	// data is raw config of app added or updated over rpc without persist,
+	// it is passed to re-executed daemon on upgrade
+	data []byte
 }
 
 func (c *AppConfig) clean(g *Config) error {
 	if c.Name == "" {
 		return ErrNameRequired
 	}
+	// name is used as file name when app config is persisted
+	if strings.Contains(c.Name, "/") || strings.Contains(c.Name, "..") {
+		return ErrInvalidName
+	}
 	if c.Command == "" {
 		return ErrCommandRequired
 	}
+	for _, group := range c.Groups {
+		if group == "" || strings.ContainsAny(group, "*?[\\ ") {
+			return ErrInvalidGroup
+		}
+	}
 
 	if !c.hasPortBadge() {
 		return ErrPortBadgeRequired
 	}
 
-	if c.StopSignalName == "" {
-		c.StopSignalName = defaultStopSignal
+	if len(c.StopSequence) > 0 {
+		if c.StopSignalName != "" || c.StopTimeout != 0 {
+			return ErrStopSequence
+		}
+		for i, step := range c.StopSequence {
+			if err := step.clean(g); err != nil {
+				return err
+			}
+			if step.Timeout <= 0 && i < len(c.StopSequence)-1 {
+				return ErrStopStepTimeout
+			}
+		}
+		c.stopSequence = c.StopSequence
+	} else {
+		if c.StopSignalName == "" {
+			c.StopSignalName = defaultStopSignal
+		}
+		step := &StopStepConfig{SignalName: c.StopSignalName, Timeout: c.StopTimeout}
+		if err := step.clean(g); err != nil {
+			return err
+		}
+		c.stopSequence = []*StopStepConfig{step}
 	}
-	signal, ok := Signals[c.StopSignalName]
-	if !ok {
-		return ErrInvalidStopSignal
+	c.StopSignal = c.stopSequence[0].Signal
+
+	if c.DrainTimeout < 0 {
+		return ErrInvalidDrain
+	}
+
+	if c.MaxProxyErrors < 0 {
+		return ErrMaxProxyErrors
 	}
-	c.StopSignal = signal
 
 	if c.MaxRetries == 0 {
 		c.MaxRetries = defaultMaxRetries
 	}
 
+	if c.History < 0 {
+		return ErrInvalidHistory
+	}
+	if c.History == 0 {
+		c.History = defaultHistory
+	}
+
+	if c.KeepExited < 0 {
+		return ErrInvalidKeepExited
+	}
+	if c.KeepExited == 0 {
+		c.KeepExited = defaultKeepExited
+	}
+
+	if c.Restart == "" {
+		c.Restart = defaultRestart
+	}
+	if c.Restart != RestartAlways && c.Restart != RestartOnFailure && c.Restart != RestartNever {
+		return ErrInvalidRestart
+	}
+
+	if c.Backoff == nil {
+		c.Backoff = &BackoffConfig{}
+	}
+	if err := c.Backoff.clean(g); err != nil {
+		return err
+	}
+
 	if c.InternalHost == "" {
 		c.InternalHost = defaultHost
 	}
@@ -154,6 +759,15 @@ func (c *AppConfig) clean(g *Config) error {
 		c.ExternalPort = defaultExternalPort
 	}
 
+	if c.PortRange != nil {
+		if c.PortRange.From >= c.PortRange.To {
+			return ErrInvalidPortRange
+		}
+		if g.PortRange != nil && (c.PortRange.From < g.PortRange.From || c.PortRange.To > g.PortRange.To) {
+			return ErrPortRangeOutside
+		}
+	}
+
 	if c.Logger == nil {
 		c.Logger = &LoggerConfig{
 			LogDir:      g.Logger.LogDir,
@@ -183,6 +797,91 @@ func (c *AppConfig) clean(g *Config) error {
 		return ErrInvalidProxyType
 	}
 
+	if c.Replicas == 0 {
+		c.Replicas = defaultReplicas
+	}
+	if c.Replicas < 0 {
+		return ErrInvalidReplicas
+	}
+
+	if c.Rollout != nil {
+		if err := c.Rollout.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.HealthCheck == nil && c.Proxy == ProxyTypeTCP {
+		c.HealthCheck = &HealthCheckConfig{Type: HealthCheckTCP}
+	}
+	if c.HealthCheck != nil {
+		if err := c.HealthCheck.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.ReadyPattern != "" {
+		readyPattern, err := regexp.Compile(c.ReadyPattern)
+		if err != nil {
+			return fmt.Errorf("ready_pattern: %s", err)
+		}
+		c.readyPattern = readyPattern
+	}
+
+	for _, warmup := range c.Warmup {
+		if err := warmup.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.Liveness != nil {
+		if c.HealthCheck == nil {
+			return ErrLivenessCheck
+		}
+		if err := c.Liveness.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.Rollback != nil {
+		if err := c.Rollback.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.Shadow != nil {
+		if c.Proxy != ProxyTypeHTTP {
+			return ErrShadowProxy
+		}
+		if err := c.Shadow.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.DebugRouting != nil {
+		if err := c.DebugRouting.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.Hooks != nil {
+		if err := c.Hooks.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.Lifecycle != nil {
+		if err := c.Lifecycle.clean(g); err != nil {
+			return err
+		}
+	}
+
+	if c.Balance == "" {
+		c.Balance = defaultBalance
+	}
+	if c.Balance != BalanceRoundRobin && c.Balance != BalanceLeastConn && c.Balance != BalanceP2C {
+		return ErrInvalidBalance
+	}
+
 	return nil
 }
 
@@ -386,7 +1085,7 @@ func (c *Config) includeFile(fn string) error {
 		return fmt.Errorf("%s: %s", fn, err)
 	}
 
-	app := &AppConfig{}
+	app := &AppConfig{source: fn}
 	if err := yaml.Unmarshal(data, app); err != nil {
 		return fmt.Errorf("%s: %s", fn, err)
 	}
@@ -408,6 +1107,10 @@ func ParseConfing(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("%s: %s", fn, err)
 	}
 
+	for _, app := range config.Apps {
+		app.source = fn
+	}
+
 	for _, inc := range config.Include {
 		if err := config.include(inc); err != nil {
 			return nil, err
@@ -98,6 +98,15 @@ func TestAppClean(t *testing.T) {
 	if appConfig.MaxRetries != defaultMaxRetries {
 		t.Error("Incorrect default max retries set:", appConfig.MaxRetries)
 	}
+	if appConfig.Restart != defaultRestart {
+		t.Error("Incorrect default restart policy set:", appConfig.Restart)
+	}
+	if appConfig.Backoff.InitialDelay != defaultBackoffInitialDelay || appConfig.Backoff.MaxDelay != defaultBackoffMaxDelay {
+		t.Error("Incorrect default backoff set:", appConfig.Backoff)
+	}
+	if appConfig.Replicas != defaultReplicas || appConfig.Balance != defaultBalance {
+		t.Error("Incorrect default replicas or balance set:", appConfig.Replicas, appConfig.Balance)
+	}
 	if appConfig.InternalHost != defaultHost {
 		t.Error("Incorrect default internal host set:", appConfig.InternalHost)
 	}
@@ -151,6 +160,169 @@ func TestAppClean(t *testing.T) {
 	if appConfig.clean(config) != ErrInvalidStopSignal {
 		t.Error("AppConfig.clean should fail with invalid signal name")
 	}
+	appConfig.StopSignalName = "TERM"
+
+	appConfig.StopSequence = []*StopStepConfig{{SignalName: "TERM", Timeout: 10}, {SignalName: "QUIT"}}
+	if appConfig.clean(config) != ErrStopSequence {
+		t.Error("AppConfig.clean should not allow stop_sequence with stop_signal")
+	}
+	appConfig.StopSignalName = ""
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails for stop_sequence:", err)
+	}
+	if len(appConfig.stopSequence) != 2 || appConfig.stopSequence[1].Signal != syscall.SIGQUIT {
+		t.Error("Stop sequence signals should be parsed")
+	}
+	appConfig.StopSequence[0].Timeout = 0
+	if appConfig.clean(config) != ErrStopStepTimeout {
+		t.Error("AppConfig.clean should require timeout for all but last stop step")
+	}
+	appConfig.StopSequence[0].Timeout = -1
+	if appConfig.clean(config) != ErrStopTimeout {
+		t.Error("AppConfig.clean should fail with negative stop step timeout")
+	}
+	appConfig.StopSequence = nil
+	appConfig.StopSignalName = "TERM"
+
+	appConfig.DrainTimeout = -1
+	if appConfig.clean(config) != ErrInvalidDrain {
+		t.Error("AppConfig.clean should fail with negative drain timeout")
+	}
+	appConfig.DrainTimeout = 0
+
+	appConfig.MaxProxyErrors = -1
+	if appConfig.clean(config) != ErrMaxProxyErrors {
+		t.Error("AppConfig.clean should fail with negative max proxy errors")
+	}
+	appConfig.MaxProxyErrors = 0
+
+	appConfig.Lifecycle = &LifecycleConfig{Active: &LifecycleHookConfig{SignalName: "USR1", Path: "/active"}}
+	if appConfig.clean(config) != ErrLifecycleHook {
+		t.Error("AppConfig.clean should fail with lifecycle hook with both signal and path")
+	}
+	appConfig.Lifecycle.Active.Path = ""
+	if err := appConfig.clean(config); err != nil || appConfig.Lifecycle.Active.Signal != syscall.SIGUSR1 {
+		t.Error("AppConfig.clean should parse lifecycle hook signal:", err)
+	}
+	appConfig.Lifecycle = nil
+
+	appConfig.Hooks = &HooksConfig{PreStart: &HookConfig{}}
+	if appConfig.clean(config) != ErrHookCommand {
+		t.Error("AppConfig.clean should fail with hook without command")
+	}
+	appConfig.Hooks.PreStart.Command = "migrate"
+	if err := appConfig.clean(config); err != nil || appConfig.Hooks.PreStart.Timeout != defaultHookTimeout {
+		t.Error("AppConfig.clean should set default hook timeout:", err)
+	}
+	appConfig.Hooks = nil
+
+	appConfig.Warmup = []*WarmupConfig{{Concurrency: -1}}
+	if appConfig.clean(config) != ErrInvalidWarmup {
+		t.Error("AppConfig.clean should fail with negative warmup concurrency")
+	}
+	appConfig.Warmup[0].Concurrency = 0
+	if err := appConfig.clean(config); err != nil || appConfig.Warmup[0].Method != "GET" || appConfig.Warmup[0].Repeat != 1 {
+		t.Error("AppConfig.clean should set warmup defaults:", err)
+	}
+	appConfig.Warmup = nil
+
+	appConfig.DebugRouting = &DebugRoutingConfig{AllowedIPs: []string{"10.0.0.0/8", "localhost"}}
+	if appConfig.clean(config) != ErrInvalidAllowedIP {
+		t.Error("AppConfig.clean should fail with invalid debug routing allowed ip")
+	}
+	appConfig.DebugRouting.AllowedIPs = []string{"10.0.0.0/8", "192.168.1.1", "::1"}
+	if err := appConfig.clean(config); err != nil || len(appConfig.DebugRouting.allowedNets) != 3 {
+		t.Error("AppConfig.clean should parse debug routing allowed ips:", err)
+	}
+	appConfig.DebugRouting = nil
+
+	appConfig.Shadow = &ShadowConfig{Methods: []string{"get", "POST"}}
+	if appConfig.clean(config) != ErrShadowMethod {
+		t.Error("AppConfig.clean should fail with non idempotent shadow method")
+	}
+	appConfig.Shadow.Methods = []string{"get"}
+	if err := appConfig.clean(config); err != nil || appConfig.Shadow.Methods[0] != "GET" || appConfig.Shadow.Percent != defaultShadowPercent {
+		t.Error("AppConfig.clean should set shadow defaults:", err)
+	}
+	appConfig.Shadow.Percent = 101
+	if appConfig.clean(config) != ErrShadowPercent {
+		t.Error("AppConfig.clean should fail with invalid shadow percent")
+	}
+	appConfig.Shadow = nil
+
+	appConfig.KeepExited = -1
+	if appConfig.clean(config) != ErrInvalidKeepExited {
+		t.Error("AppConfig.clean should fail with negative keep_exited")
+	}
+	appConfig.KeepExited = 0
+	if err := appConfig.clean(config); err != nil || appConfig.KeepExited != defaultKeepExited {
+		t.Error("AppConfig.clean should set default keep_exited:", err)
+	}
+
+	appConfig.Restart = "sometimes"
+	if appConfig.clean(config) != ErrInvalidRestart {
+		t.Error("AppConfig.clean should fail with invalid restart policy")
+	}
+	appConfig.Restart = RestartNever
+
+	appConfig.Backoff.Multiplier = 0.5
+	if appConfig.clean(config) != ErrInvalidBackoff {
+		t.Error("AppConfig.clean should fail with backoff multiplier below 1")
+	}
+	appConfig.Backoff.Multiplier = 2
+
+	appConfig.Balance = "random"
+	if appConfig.clean(config) != ErrInvalidBalance {
+		t.Error("AppConfig.clean should fail with invalid balance")
+	}
+	appConfig.Balance = BalanceRoundRobin
+
+	appConfig.Rollout = &RolloutConfig{}
+	if appConfig.clean(config) != ErrRolloutSteps {
+		t.Error("AppConfig.clean should fail with empty rollout")
+	}
+	appConfig.Rollout.Steps = []*RolloutStepConfig{&RolloutStepConfig{Weight: 150}}
+	if appConfig.clean(config) != ErrInvalidWeight {
+		t.Error("AppConfig.clean should fail with invalid rollout weight")
+	}
+	appConfig.Rollout = nil
+
+	appConfig.Rollback = &RollbackConfig{}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with empty rollback:", err)
+	}
+	if appConfig.Rollback.Window != defaultRollbackWindow || appConfig.Rollback.Threshold != defaultRollbackThreshold {
+		t.Error("Incorrect default rollback set:", appConfig.Rollback)
+	}
+	appConfig.Rollback.Threshold = 200
+	if appConfig.clean(config) != ErrInvalidThreshold {
+		t.Error("AppConfig.clean should fail with invalid rollback threshold")
+	}
+	appConfig.Rollback = nil
+
+	appConfig.Groups = []string{"web", "*"}
+	if appConfig.clean(config) != ErrInvalidGroup {
+		t.Error("AppConfig.clean should fail with invalid group name")
+	}
+	appConfig.Groups = nil
+
+	appConfig.ReadyPattern = "listening on ("
+	if appConfig.clean(config) == nil {
+		t.Error("AppConfig.clean should fail with invalid ready pattern")
+	}
+	appConfig.ReadyPattern = ""
+
+	appConfig.Liveness = &LivenessConfig{}
+	if appConfig.clean(config) != ErrLivenessCheck {
+		t.Error("AppConfig.clean should fail with liveness and no healthcheck")
+	}
+	appConfig.HealthCheck = &HealthCheckConfig{Path: "/health"}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with liveness:", err)
+	}
+	if appConfig.Liveness.Interval != defaultLivenessInterval || appConfig.Liveness.FailureThreshold != defaultLivenessFailureThreshold {
+		t.Error("Incorrect default liveness set:", appConfig.Liveness)
+	}
 }
 
 func TestAppHasPortBadge(t *testing.T) {
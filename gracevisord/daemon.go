@@ -0,0 +1,471 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+var (
+	ErrAppExists       = errors.New("App with this name already exists")
+	ErrNoIncludeDir    = errors.New("Config cannot be persisted without apps_include dir")
+	ErrPersistMainFile = errors.New("App is defined in main config file and cannot be persisted")
+	ErrNoMatchingApps  = errors.New("No apps match")
+)
+
+// Daemon keeps registry of running apps and applies config reloads
+type Daemon struct {
+	configPath string
+	config     *Config
+	portPool   *PortPool
+
+	apps     map[string]*App
+	appsLock sync.RWMutex
+
+	// reloadLock serializes reloads
+	reloadLock sync.Mutex
+	upgrading  int32
+}
+
+func NewDaemon(configPath string, config *Config) *Daemon {
+	return &Daemon{
+		configPath: configPath,
+		config:     config,
+		portPool:   NewPortPool(config.PortRange.From, config.PortRange.To),
+		apps:       map[string]*App{},
+	}
+}
+
+// Run starts all apps and serves rpc, it reloads config on SIGHUP and
+// upgrades daemon on SIGUSR2. Apps are adopted from previous daemon process
+// if it passed its state.
+func (d *Daemon) Run() {
+	if stateFd := os.Getenv(UpgradeStateEnv); stateFd != "" {
+		os.Unsetenv(UpgradeStateEnv)
+		if err := d.adoptApps(stateFd); err != nil {
+			log.Print("Cannot adopt apps: ", err)
+		}
+	}
+	d.startApps()
+	go d.handleSignals()
+
+	rpcListener, err := NewRpcServer(d, d.config.Rpc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := http.Serve(rpcListener, nil); err != nil {
+		log.Print("Rpc server error:", err)
+	}
+
+	// keep apps running without rpc
+	select {}
+}
+
+func (d *Daemon) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Print("Reloading config")
+			if err := d.Reload(); err != nil {
+				log.Print("Reload failed: ", err)
+			}
+		case syscall.SIGUSR2:
+			if err := d.Upgrade(); err != nil {
+				log.Print("Upgrade failed: ", err)
+			}
+		}
+	}
+}
+
+func (d *Daemon) startApps() {
+	for _, appConfig := range d.config.Apps {
+		if _, ok := d.App(appConfig.Name); ok {
+			// adopted from previous daemon process
+			continue
+		}
+		if err := d.startApp(appConfig); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (d *Daemon) startApp(config *AppConfig) error {
+	app := NewApp(config, d.portPool)
+	if err := app.Start(); err != nil {
+		app.Shutdown()
+		return fmt.Errorf("%s: %s", config.Name, err)
+	}
+
+	d.appsLock.Lock()
+	d.apps[config.Name] = app
+	d.appsLock.Unlock()
+	return nil
+}
+
+// App returns running app by name
+func (d *Daemon) App(name string) (*App, bool) {
+	d.appsLock.RLock()
+	defer d.appsLock.RUnlock()
+	app, ok := d.apps[name]
+	return app, ok
+}
+
+// Apps returns running apps sorted by name
+func (d *Daemon) Apps() []*App {
+	d.appsLock.RLock()
+	defer d.appsLock.RUnlock()
+
+	names := make([]string, 0, len(d.apps))
+	for name := range d.apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	apps := make([]*App, 0, len(names))
+	for _, name := range names {
+		apps = append(apps, d.apps[name])
+	}
+	return apps
+}
+
+// MatchApps returns sorted names of apps that match any of glob patterns or
+// belong to any of groups, or names of all apps. Patterns without glob
+// characters must name an existing app.
+func (d *Daemon) MatchApps(patterns, groups []string, all bool) ([]string, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		if !strings.ContainsAny(pattern, "*?[\\") {
+			if _, ok := d.App(pattern); !ok {
+				return nil, fmt.Errorf("%s: %s", pattern, ErrInvalidApp)
+			}
+		}
+	}
+
+	d.appsLock.RLock()
+	apps := make(map[string]*App, len(d.apps))
+	for name, app := range d.apps {
+		apps[name] = app
+	}
+	d.appsLock.RUnlock()
+
+	names := []string{}
+	for name, app := range apps {
+		matches := all
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				matches = true
+			}
+		}
+		for _, group := range groups {
+			for _, appGroup := range app.Groups() {
+				if group == appGroup {
+					matches = true
+				}
+			}
+		}
+		if matches {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, ErrNoMatchingApps
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reload parses config again and applies the difference to running apps.
+// Removed apps are stopped, new apps are started and apps with changed
+// config get their instances replaced. Running apps are left untouched
+// if the new config is not valid.
+func (d *Daemon) Reload() error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	config, err := ParseConfing(d.configPath)
+	if err != nil {
+		return err
+	}
+
+	if *config.PortRange != *d.config.PortRange || *config.Rpc != *d.config.Rpc || *config.Logger != *d.config.Logger {
+		log.Print("Changes of port_range, rpc and logger settings are applied on restart")
+	}
+
+	oldConfigs := map[string]*AppConfig{}
+	for _, appConfig := range d.config.Apps {
+		oldConfigs[appConfig.Name] = appConfig
+	}
+	newConfigs := map[string]*AppConfig{}
+	for _, appConfig := range config.Apps {
+		newConfigs[appConfig.Name] = appConfig
+	}
+
+	// remove apps first so their external ports can be reused
+	for name := range oldConfigs {
+		if _, ok := newConfigs[name]; ok {
+			continue
+		}
+		if app, ok := d.App(name); ok {
+			log.Printf("%s: Removing app", name)
+			app.Shutdown()
+
+			d.appsLock.Lock()
+			delete(d.apps, name)
+			d.appsLock.Unlock()
+		}
+	}
+
+	// recorded configs are the ones apps run with, so apps that failed to
+	// start or update are retried on next reload
+	var errs []string
+	apps := []*AppConfig{}
+	for _, appConfig := range config.Apps {
+		app, ok := d.App(appConfig.Name)
+		if !ok {
+			log.Printf("%s: Adding app", appConfig.Name)
+			if err := d.startApp(appConfig); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			apps = append(apps, appConfig)
+			continue
+		}
+
+		if oldConfig, ok := oldConfigs[appConfig.Name]; ok && oldConfig.equal(appConfig) {
+			apps = append(apps, oldConfig)
+			continue
+		}
+		log.Printf("%s: Updating app", appConfig.Name)
+		if err := app.Update(appConfig); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", appConfig.Name, err))
+		}
+		apps = append(apps, app.Config())
+	}
+	config.Apps = apps
+
+	// global settings are only changed on restart
+	config.PortRange = d.config.PortRange
+	config.Rpc = d.config.Rpc
+	config.Logger = d.config.Logger
+	d.config = config
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// equal compares cleaned app configs
+func (c *AppConfig) equal(other *AppConfig) bool {
+	a, err := yaml.Marshal(c)
+	if err != nil {
+		return false
+	}
+	b, err := yaml.Marshal(other)
+	if err != nil {
+		return false
+	}
+	return string(a) == string(b)
+}
+
+// parseAppConfig parses and validates app config received over rpc
+func (d *Daemon) parseAppConfig(data []byte) (*AppConfig, error) {
+	config := &AppConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.clean(d.config); err != nil {
+		return nil, fmt.Errorf("%s: %s", config.Name, err)
+	}
+	return config, nil
+}
+
+// checkExternalPort returns error if external port of app is used by another
+// app
+func (d *Daemon) checkExternalPort(config *AppConfig) error {
+	for _, other := range d.config.Apps {
+		if other.Name != config.Name && other.ExternalPort == config.ExternalPort {
+			return fmt.Errorf("%s: Cannot use duplicate external port %d", config.Name, config.ExternalPort)
+		}
+	}
+	return nil
+}
+
+// includeDir returns first apps_include dir, new app configs are persisted
+// there
+func (d *Daemon) includeDir() (string, error) {
+	for _, inc := range d.config.Include {
+		if fi, err := os.Stat(inc); err == nil && fi.IsDir() {
+			return inc, nil
+		}
+	}
+	return "", ErrNoIncludeDir
+}
+
+// persistPath returns config file app config should be written to
+func (d *Daemon) persistPath(config *AppConfig) (string, error) {
+	if config.source == "" {
+		dir, err := d.includeDir()
+		if err != nil {
+			return "", err
+		}
+		return path.Join(dir, config.Name+".yaml"), nil
+	}
+	if path.Base(config.source) == configFile {
+		return "", ErrPersistMainFile
+	}
+	return config.source, nil
+}
+
+// replaceAppConfig replaces config of app with the same name in daemon
+// config, or adds it if there is none
+func (d *Daemon) replaceAppConfig(config *AppConfig) {
+	for i, other := range d.config.Apps {
+		if other.Name == config.Name {
+			d.config.Apps[i] = config
+			return
+		}
+	}
+	d.config.Apps = append(d.config.Apps, config)
+}
+
+// AddApp validates and starts a new app. If persist is set, app config is
+// written to apps_include dir.
+func (d *Daemon) AddApp(data []byte, persist bool) error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	config, err := d.parseAppConfig(data)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.App(config.Name); ok {
+		return ErrAppExists
+	}
+	if err := d.checkExternalPort(config); err != nil {
+		return err
+	}
+
+	if persist {
+		fn, err := d.persistPath(config)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(fn); err == nil {
+			return fmt.Errorf("%s: File already exists", fn)
+		}
+		if err := ioutil.WriteFile(fn, data, defaultConfigFileMode); err != nil {
+			return err
+		}
+		config.source = fn
+	} else {
+		config.data = data
+	}
+
+	log.Printf("%s: Adding app", config.Name)
+	if err := d.startApp(config); err != nil {
+		return err
+	}
+	d.replaceAppConfig(config)
+	return nil
+}
+
+// UpdateApp validates new config of running app and replaces its instances.
+// If persist is set, config file of the app is overwritten.
+func (d *Daemon) UpdateApp(data []byte, persist bool) error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	config, err := d.parseAppConfig(data)
+	if err != nil {
+		return err
+	}
+	app, ok := d.App(config.Name)
+	if !ok {
+		return ErrInvalidApp
+	}
+	if err := d.checkExternalPort(config); err != nil {
+		return err
+	}
+
+	for _, other := range d.config.Apps {
+		if other.Name == config.Name {
+			config.source = other.source
+		}
+	}
+	if persist {
+		fn, err := d.persistPath(config)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fn, data, defaultConfigFileMode); err != nil {
+			return err
+		}
+		config.source = fn
+	} else {
+		config.data = data
+	}
+
+	log.Printf("%s: Updating app", config.Name)
+	err = app.Update(config)
+	d.replaceAppConfig(app.Config())
+	if err != nil {
+		return fmt.Errorf("%s: %s", config.Name, err)
+	}
+	return nil
+}
+
+// RemoveApp stops app after its instances finish serving open connections.
+// If persist is set, config file of the app is removed.
+func (d *Daemon) RemoveApp(name string, persist bool) error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	app, ok := d.App(name)
+	if !ok {
+		return ErrInvalidApp
+	}
+
+	apps := make([]*AppConfig, 0, len(d.config.Apps))
+	for _, config := range d.config.Apps {
+		if config.Name != name {
+			apps = append(apps, config)
+			continue
+		}
+		if persist && config.source != "" {
+			fn, err := d.persistPath(config)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("%s: Removing app", name)
+	app.Shutdown()
+
+	d.appsLock.Lock()
+	delete(d.apps, name)
+	d.appsLock.Unlock()
+
+	d.config.Apps = apps
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func freePort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func writeTestConfig(t *testing.T, dir, apps string) {
+	config := fmt.Sprintf("port_range:\n  from: 20000\n  to: 21000\nlogger:\n  log_dir: %s\napps:\n%s", dir, apps)
+	if err := ioutil.WriteFile(path.Join(dir, configFile), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAppConfig(name, command string, port uint16) string {
+	return fmt.Sprintf("  - name: %s\n    command: %s\n    environment: [\"PORT={port}\"]\n    external_port: %d\n", name, command, port)
+}
+
+func TestDaemonReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	portA, portB, portC := freePort(t), freePort(t), freePort(t)
+	writeTestConfig(t, dir, testAppConfig("a", "sleep 30", portA)+testAppConfig("b", "sleep 30", portB))
+
+	config, err := ParseConfing(dir)
+	if err != nil {
+		t.Fatal("Parse config failed:", err)
+	}
+	daemon := NewDaemon(dir, config)
+	daemon.startApps()
+	defer func() {
+		for _, app := range daemon.Apps() {
+			app.Shutdown()
+		}
+	}()
+
+	appA, _ := daemon.App("a")
+	appB, ok := daemon.App("b")
+	if !ok {
+		t.Fatal("App should be started")
+	}
+	waitFor(t, appB, "app b active", func() bool {
+		return len(appB.activeInstances) == 1
+	})
+
+	writeTestConfig(t, dir, testAppConfig("b", "sleep 31", portC)+testAppConfig("c", "sleep 30", portA))
+	if err := daemon.Reload(); err != nil {
+		t.Fatal("Reload failed:", err)
+	}
+
+	if _, ok := daemon.App("a"); ok {
+		t.Error("Removed app should not be running")
+	}
+	if _, ok := daemon.App("c"); !ok {
+		t.Error("Added app should be running")
+	}
+	waitFor(t, appA, "removed app stopped", func() bool {
+		return len(appA.activeInstances) == 0 && appA.instances[0].status == InstanceStatusStopped
+	})
+	waitFor(t, appB, "changed app instance replaced", func() bool {
+		return len(appB.activeInstances) == 1 && appB.activeInstances[0].id == 2
+	})
+
+	if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", portC)); err != nil {
+		t.Error("Changed app should listen on new port:", err)
+	} else {
+		conn.Close()
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", portB)); err == nil {
+		conn.Close()
+		t.Error("Changed app should not listen on old port")
+	}
+
+	writeTestConfig(t, dir, testAppConfig("b", "", portC))
+	if err := daemon.Reload(); err == nil {
+		t.Error("Reload should fail for invalid config")
+	}
+	if len(daemon.Apps()) != 2 {
+		t.Error("Failed reload should not change running apps")
+	}
+}
+
+func TestDaemonReloadFailedUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	portA := freePort(t)
+	blocker, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	portB := uint16(blocker.Addr().(*net.TCPAddr).Port)
+	writeTestConfig(t, dir, testAppConfig("a", "sleep 30", portA))
+
+	config, err := ParseConfing(dir)
+	if err != nil {
+		t.Fatal("Parse config failed:", err)
+	}
+	daemon := NewDaemon(dir, config)
+	daemon.startApps()
+	defer func() {
+		for _, app := range daemon.Apps() {
+			app.Shutdown()
+		}
+	}()
+
+	writeTestConfig(t, dir, testAppConfig("a", "sleep 30", portB))
+	if err := daemon.Reload(); err == nil {
+		t.Fatal("Reload should fail when app cannot listen")
+	}
+	if port := daemon.config.Apps[0].ExternalPort; port != portA {
+		t.Error("Config of failed app update should not be recorded:", port)
+	}
+
+	// failed update is retried on next reload
+	blocker.Close()
+	if err := daemon.Reload(); err != nil {
+		t.Fatal("Reload failed:", err)
+	}
+	if port := daemon.config.Apps[0].ExternalPort; port != portB {
+		t.Error("Config of updated app should be recorded:", port)
+	}
+}
+
+func TestDaemonManageApps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	includeDir := path.Join(dir, "apps")
+	if err := os.Mkdir(includeDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	writeTestConfig(t, dir, testAppConfig("a", "sleep 30", port))
+	ioutil.WriteFile(path.Join(dir, configFile), append([]byte("apps_include: ["+includeDir+"]\n"), mustRead(t, path.Join(dir, configFile))...), 0600)
+
+	config, err := ParseConfing(dir)
+	if err != nil {
+		t.Fatal("Parse config failed:", err)
+	}
+	daemon := NewDaemon(dir, config)
+	daemon.startApps()
+	defer func() {
+		for _, app := range daemon.Apps() {
+			app.Shutdown()
+		}
+	}()
+
+	appConfig := fmt.Sprintf("name: b\ncommand: sleep 30\nenvironment: [\"PORT={port}\"]\nexternal_port: %d\n", freePort(t))
+	if err := daemon.AddApp([]byte(appConfig), true); err != nil {
+		t.Fatal("Add app failed:", err)
+	}
+	if daemon.AddApp([]byte(appConfig), false) != ErrAppExists {
+		t.Error("Adding app with the same name should fail")
+	}
+	if daemon.AddApp([]byte(fmt.Sprintf("name: c\ncommand: sleep 30\nenvironment: [\"PORT={port}\"]\nexternal_port: %d\n", port)), false) == nil {
+		t.Error("Adding app with used external port should fail")
+	}
+	if daemon.AddApp([]byte("name: c\n"), false) == nil {
+		t.Error("Adding invalid app should fail")
+	}
+	invalidName := fmt.Sprintf("name: ../../c\ncommand: sleep 30\nenvironment: [\"PORT={port}\"]\nexternal_port: %d\n", freePort(t))
+	if err := daemon.AddApp([]byte(invalidName), true); err == nil || !strings.HasSuffix(err.Error(), ErrInvalidName.Error()) {
+		t.Error("Adding app with name outside apps_include should fail:", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "c.yaml")); !os.IsNotExist(err) {
+		t.Error("App config should not be written outside apps_include")
+	}
+
+	appB, ok := daemon.App("b")
+	if !ok {
+		t.Fatal("Added app should be running")
+	}
+	if !bytes.Equal(mustRead(t, path.Join(includeDir, "b.yaml")), []byte(appConfig)) {
+		t.Error("Added app config should be persisted")
+	}
+
+	appConfig = strings.Replace(appConfig, "sleep 30", "sleep 31", 1)
+	if err := daemon.UpdateApp([]byte(appConfig), true); err != nil {
+		t.Fatal("Update app failed:", err)
+	}
+	waitFor(t, appB, "updated app instance serving", func() bool {
+		return len(appB.activeInstances) == 1 && appB.activeInstances[0].config.Command == "sleep 31"
+	})
+	if !bytes.Equal(mustRead(t, path.Join(includeDir, "b.yaml")), []byte(appConfig)) {
+		t.Error("Updated app config should be persisted")
+	}
+
+	if err := daemon.RemoveApp("a", true); err != ErrPersistMainFile {
+		t.Error("App from main config file cannot be removed with persist:", err)
+	}
+	if err := daemon.RemoveApp("b", true); err != nil {
+		t.Fatal("Remove app failed:", err)
+	}
+	if _, ok := daemon.App("b"); ok {
+		t.Error("Removed app should not be running")
+	}
+	if _, err := os.Stat(path.Join(includeDir, "b.yaml")); !os.IsNotExist(err) {
+		t.Error("Removed app config file should be deleted")
+	}
+
+	config, err = ParseConfing(dir)
+	if err != nil || len(config.Apps) != 1 {
+		t.Error("Persisted config should be valid:", err)
+	}
+}
+
+func mustRead(t *testing.T, fn string) []byte {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDaemonMatchApps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	web := "    groups: [web]\n"
+	writeTestConfig(t, dir, testAppConfig("api-a", "sleep 30", freePort(t))+web+
+		testAppConfig("api-b", "sleep 30", freePort(t))+
+		testAppConfig("worker", "sleep 30", freePort(t))+web)
+
+	config, err := ParseConfing(dir)
+	if err != nil {
+		t.Fatal("Parse config failed:", err)
+	}
+	daemon := NewDaemon(dir, config)
+	daemon.startApps()
+	defer func() {
+		for _, app := range daemon.Apps() {
+			app.Shutdown()
+		}
+	}()
+
+	for _, test := range []struct {
+		patterns []string
+		groups   []string
+		all      bool
+		names    string
+	}{
+		{all: true, names: "api-a api-b worker"},
+		{patterns: []string{"api-*"}, names: "api-a api-b"},
+		{groups: []string{"web"}, names: "api-a worker"},
+		{patterns: []string{"api-b"}, groups: []string{"web"}, names: "api-a api-b worker"},
+	} {
+		names, err := daemon.MatchApps(test.patterns, test.groups, test.all)
+		if err != nil || strings.Join(names, " ") != test.names {
+			t.Errorf("Incorrect apps matched for %v %v: %v %v", test.patterns, test.groups, names, err)
+		}
+	}
+
+	if _, err := daemon.MatchApps([]string{"db-*"}, nil, false); err != ErrNoMatchingApps {
+		t.Error("Match should fail when no apps match:", err)
+	}
+	if _, err := daemon.MatchApps([]string{"api-a", "api-c"}, nil, false); err == nil || !strings.Contains(err.Error(), "api-c") {
+		t.Error("Match should fail when named app does not exist:", err)
+	}
+	if _, err := daemon.MatchApps([]string{"api-["}, nil, false); err == nil {
+		t.Error("Match should fail with invalid pattern")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// requestedInstance returns instance id requested with header or cookie if
+// request comes from allowed ip
+func (c *DebugRoutingConfig) requestedInstance(req *http.Request) (uint32, bool) {
+	value := req.Header.Get(c.Header)
+	if value == "" {
+		cookie, err := req.Cookie(c.Cookie)
+		if err != nil {
+			return 0, false
+		}
+		value = cookie.Value
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	if !c.allowed(req.RemoteAddr) {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+func (c *DebugRoutingConfig) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, allowedNet := range c.allowedNets {
+		if allowedNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setServing makes serving instance reachable with debug routing, called
+// by supervisor on instance status change
+func (a *App) setServing(instance *Instance, serving bool) {
+	a.activeInstanceLock.Lock()
+	if serving {
+		a.servingInstances[instance.id] = instance
+	} else {
+		delete(a.servingInstances, instance.id)
+	}
+	a.activeInstanceLock.Unlock()
+}
+
+func (a *App) debugRoutingConfig() *DebugRoutingConfig {
+	a.activeInstanceLock.RLock()
+	defer a.activeInstanceLock.RUnlock()
+	return a.debugRouting
+}
+
+// reserveRequestInstance reserves serving instance requested with debug
+// routing, other requests get an active instance
+func (a *App) reserveRequestInstance(req *http.Request, debug *DebugRoutingConfig) (*Instance, error) {
+	if debug == nil {
+		return a.reserveInstance()
+	}
+	id, ok := debug.requestedInstance(req)
+	if !ok {
+		return a.reserveInstance()
+	}
+
+	a.activeInstanceLock.RLock()
+	defer a.activeInstanceLock.RUnlock()
+
+	instance, ok := a.servingInstances[id]
+	if !ok {
+		return nil, ErrInstanceNotRunning
+	}
+	instance.Serve()
+	return instance, nil
+}
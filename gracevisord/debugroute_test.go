@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReverseProxyDebugRouting(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:      "sleep 30",
+		DebugRouting: &DebugRoutingConfig{AllowedIPs: []string{"10.0.0.0/8"}},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+	if err := app.Hold(); err != nil {
+		t.Fatal("Hold failed:", err)
+	}
+	waitFor(t, app, "held instance ready", func() bool {
+		return len(app.held) == 1 && app.held[0].status == InstanceStatusServing
+	})
+
+	var instances []*Instance
+	app.do(func() {
+		instances = app.instances
+	})
+	for _, instance := range instances {
+		newTestServer(t, instance, func() int { return http.StatusOK })
+	}
+
+	for _, test := range []struct {
+		remoteAddr string
+		header     string
+		cookie     string
+		status     int
+		instance   string
+	}{
+		{"10.1.2.3:5000", "", "", http.StatusOK, "1"},
+		{"10.1.2.3:5000", "2", "", http.StatusOK, "2"},
+		{"10.1.2.3:5000", "", "2", http.StatusOK, "2"},
+		{"10.1.2.3:5000", "1", "2", http.StatusOK, "1"},
+		{"192.168.1.1:5000", "2", "", http.StatusOK, "1"},
+		{"10.1.2.3:5000", "9", "", http.StatusServiceUnavailable, ""},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			req.Header.Set("X-Gracevisor-Instance", test.header)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "gracevisor_instance", Value: test.cookie})
+		}
+
+		rw := httptest.NewRecorder()
+		app.rp.ServeHTTP(rw, req)
+		if rw.Code != test.status || rw.Header().Get("X-Gracevisor-Instance") != test.instance {
+			t.Errorf("Request from %s with header %q and cookie %q should be served by instance %q: %d %q",
+				test.remoteAddr, test.header, test.cookie, test.instance, rw.Code, rw.Header().Get("X-Gracevisor-Instance"))
+		}
+	}
+}
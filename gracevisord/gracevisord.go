@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"os"
 	"runtime"
-	"sync"
 
 	"github.com/hamaxx/gracevisor/deps/cli"
 	"github.com/hamaxx/gracevisor/deps/lumberjack"
@@ -27,34 +26,6 @@ func configureGracevisorLogger(config *LoggerConfig) {
 	log.SetOutput(writer)
 }
 
-func startApp(config *Config) {
-	portPool := NewPortPool(config.PortRange.From, config.PortRange.To)
-	runningApps := map[string]*App{}
-
-	appWg := sync.WaitGroup{}
-	for _, appConfig := range config.Apps {
-		appWg.Add(1)
-		app := NewApp(appConfig, portPool)
-		runningApps[app.config.Name] = app
-		go func() {
-			if err := app.ListenAndServe(); err != nil {
-				log.Print("App listen and serve error:", err)
-			}
-			appWg.Done()
-		}()
-	}
-
-	rpcListener, err := NewRpcServer(runningApps, config.Rpc)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := http.Serve(rpcListener, nil); err != nil {
-		log.Print("Rpc server error:", err)
-	}
-
-	appWg.Wait()
-}
-
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU() / 2)
 	// solution for https://github.com/golang/go/issues/6785
@@ -79,7 +50,7 @@ func main() {
 		}
 
 		configureGracevisorLogger(config.Logger)
-		startApp(config)
+		NewDaemon(c.String("conf"), config).Run()
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const maxHealthCheckBodySize = 1 << 20
+
+// Check runs health check against instance. Timeout overrides configured
+// timeout if set.
+func (c *HealthCheckConfig) Check(instance *Instance, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+
+	switch c.Type {
+	case HealthCheckTCP:
+		return c.checkTCP(instance, timeout)
+	case HealthCheckExec:
+		return c.checkExec(instance, timeout)
+	}
+	return c.checkHTTP(instance, timeout)
+}
+
+func (c *HealthCheckConfig) checkHTTP(instance *Instance, timeout time.Duration) error {
+	healthCheckUrl := url.URL{
+		Scheme: "http",
+		Host:   instance.internalHostPort,
+		Path:   c.Path,
+	}
+
+	req, err := http.NewRequest(c.Method, healthCheckUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	expected := false
+	for _, status := range c.Status {
+		if resp.StatusCode == status {
+			expected = true
+			break
+		}
+	}
+	if !expected {
+		return fmt.Errorf("Unexpected health check status %d", resp.StatusCode)
+	}
+
+	if c.Body != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodySize))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), c.Body) {
+			return fmt.Errorf("Health check response does not contain %q", c.Body)
+		}
+	}
+
+	return nil
+}
+
+func (c *HealthCheckConfig) checkTCP(instance *Instance, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", instance.internalHostPort, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *HealthCheckConfig) checkExec(instance *Instance, timeout time.Duration) error {
+	return runCommand(instance.command(c.Command), timeout)
+}
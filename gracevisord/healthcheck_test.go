@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+func TestHealthCheckUnmarshal(t *testing.T) {
+	appConfig := &AppConfig{}
+	if err := yaml.Unmarshal([]byte("healthcheck: /health"), appConfig); err != nil {
+		t.Fatal("Unmarshal of path healthcheck failed:", err)
+	}
+	if appConfig.HealthCheck.Type != HealthCheckHTTP || appConfig.HealthCheck.Path != "/health" {
+		t.Error("Path healthcheck should be http check:", appConfig.HealthCheck)
+	}
+
+	appConfig = &AppConfig{}
+	data := "healthcheck:\n  type: exec\n  command: ./check.sh\n  timeout: 5\n"
+	if err := yaml.Unmarshal([]byte(data), appConfig); err != nil {
+		t.Fatal("Unmarshal of healthcheck block failed:", err)
+	}
+	if appConfig.HealthCheck.Type != HealthCheckExec || appConfig.HealthCheck.Command != "./check.sh" || appConfig.HealthCheck.Timeout != 5 {
+		t.Error("Incorrect healthcheck block:", appConfig.HealthCheck)
+	}
+}
+
+func TestHealthCheckClean(t *testing.T) {
+	check := &HealthCheckConfig{}
+	if err := check.clean(nil); err != nil {
+		t.Error("Empty healthcheck clean failed:", err)
+	}
+	if check.Type != HealthCheckHTTP || check.Path != defaultHealthCheckPath || check.Method != defaultHealthCheckMethod {
+		t.Error("Incorrect default http healthcheck:", check)
+	}
+	if len(check.Status) != 1 || check.Status[0] != defaultHealthCheckStatus {
+		t.Error("Incorrect default healthcheck status:", check.Status)
+	}
+
+	check = &HealthCheckConfig{Type: HealthCheckExec}
+	if check.clean(nil) != ErrCheckCommand {
+		t.Error("Exec healthcheck without command should fail clean")
+	}
+
+	check = &HealthCheckConfig{Type: "udp"}
+	if check.clean(nil) != ErrInvalidCheckType {
+		t.Error("Invalid healthcheck type should fail clean")
+	}
+
+	appConfig := &AppConfig{Proxy: ProxyTypeTCP}
+	config := &Config{Logger: &LoggerConfig{LogDir: "/tmp/log-test/"}}
+	appConfig.Name = "demo"
+	appConfig.Command = "../demoapp/demoapp --port={port}"
+	if err := appConfig.clean(config); err != nil {
+		t.Error("Tcp app clean failed:", err)
+	}
+	if appConfig.HealthCheck == nil || appConfig.HealthCheck.Type != HealthCheckTCP {
+		t.Error("Tcp app should default to tcp healthcheck")
+	}
+}
+
+func newCheckInstance(hostPort string) *Instance {
+	return &Instance{
+		config:           &AppConfig{User: &UserConfig{}},
+		internalHostPort: hostPort,
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "example.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Check") != "yes" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "status: ok")
+	}))
+	defer server.Close()
+
+	instance := newCheckInstance(server.Listener.Addr().String())
+	check := &HealthCheckConfig{
+		Host:    "example.com",
+		Headers: map[string]string{"X-Check": "yes"},
+		Status:  []int{200, 202},
+		Body:    "ok",
+	}
+	check.clean(nil)
+
+	if err := check.Check(instance, 0); err != nil {
+		t.Error("Http check should pass:", err)
+	}
+
+	check.Body = "ready"
+	if check.Check(instance, 0) == nil {
+		t.Error("Http check should fail when body does not match")
+	}
+
+	check.Body = ""
+	check.Status = []int{200}
+	if check.Check(instance, 0) == nil {
+		t.Error("Http check should fail with unexpected status")
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance := newCheckInstance(listener.Addr().String())
+	check := &HealthCheckConfig{Type: HealthCheckTCP}
+	check.clean(nil)
+
+	if err := check.Check(instance, 0); err != nil {
+		t.Error("Tcp check should pass:", err)
+	}
+
+	listener.Close()
+	if check.Check(instance, 0) == nil {
+		t.Error("Tcp check should fail when nothing listens")
+	}
+}
+
+func TestHealthCheckExec(t *testing.T) {
+	instance := newCheckInstance("localhost:0")
+	check := &HealthCheckConfig{Type: HealthCheckExec, Command: "true"}
+	check.clean(nil)
+
+	if err := check.Check(instance, 0); err != nil {
+		t.Error("Exec check should pass:", err)
+	}
+
+	check.Command = "false"
+	if check.Check(instance, 0) == nil {
+		t.Error("Exec check should fail with non zero exit code")
+	}
+
+	check.Command = "sleep 5"
+	if check.Check(instance, 100*time.Millisecond) != ErrCommandTimeout {
+		t.Error("Exec check should time out")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// recordHistory stores compact record of exited instance
+func (a *App) recordHistory(instance *Instance) {
+	a.history = append(a.history, instance.Record())
+	if n := len(a.history) - a.config.History; n > 0 {
+		copy(a.history, a.history[n:])
+		for i := len(a.history) - n; i < len(a.history); i++ {
+			a.history[i] = nil
+		}
+		a.history = a.history[:len(a.history)-n]
+	}
+}
+
+// pruneInstances drops all but last keep_exited exited instances from
+// instance list, older ones are only available in history
+func (a *App) pruneInstances() {
+	exited := 0
+	instances := make([]*Instance, 0, len(a.instances))
+	for i := len(a.instances) - 1; i >= 0; i-- {
+		instance := a.instances[i]
+		if instance.terminated() {
+			exited++
+			if exited > a.config.KeepExited {
+				continue
+			}
+		}
+		instances = append(instances, instance)
+	}
+
+	for i, j := 0, len(instances)-1; i < j; i, j = i+1, j-1 {
+		instances[i], instances[j] = instances[j], instances[i]
+	}
+	a.instances = instances
+}
+
+// History returns records of exited instances, oldest first
+func (a *App) History() []*report.InstanceRecord {
+	var history []*report.InstanceRecord
+	a.do(func() {
+		history = append(history, a.history...)
+	})
+	return history
+}
+
+// terminated returns true if instance process has exited
+func (i *Instance) terminated() bool {
+	return i.status > InstanceStatusStopping
+}
+
+// Record returns compact record of exited instance
+func (i *Instance) Record() *report.InstanceRecord {
+	record := &report.InstanceRecord{
+		Id:      i.id,
+		Port:    i.internalPort,
+		Status:  i.StatusString(),
+		Started: i.started.Unix(),
+		Ended:   i.lastChange.Unix(),
+		Orphans: i.orphans,
+	}
+
+	if i.processExitState != nil {
+		record.ExitCode = i.processExitState.ExitCode()
+		if ws, ok := i.processExitState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			record.Signal = ws.Signal().String()
+		}
+	}
+	if i.processErr != nil {
+		record.Error = i.processErr.Error()
+	}
+
+	return record
+}
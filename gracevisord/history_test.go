@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAppPruneInstances(t *testing.T) {
+	app := &App{config: &AppConfig{History: 3, KeepExited: 4}}
+
+	for id := uint32(1); id <= 10; id++ {
+		instance := &Instance{id: id, status: InstanceStatusFailed}
+		if id == 2 || id == 10 {
+			instance.status = InstanceStatusServing
+		}
+		app.instances = append(app.instances, instance)
+		app.recordHistory(instance)
+		app.pruneInstances()
+	}
+
+	if len(app.instances) != 4+2 {
+		t.Error("Exited instances should be pruned:", len(app.instances))
+	}
+	if app.instances[0].id != 2 || app.instances[len(app.instances)-1].id != 10 {
+		t.Error("Running instances should be kept in order")
+	}
+	if app.instances[1].id != 6 {
+		t.Error("Oldest exited instances should be pruned first:", app.instances[1].id)
+	}
+
+	if len(app.history) != 3 {
+		t.Fatal("History should be limited to history length:", len(app.history))
+	}
+	if app.history[0].Id != 8 || app.history[2].Id != 10 {
+		t.Error("Oldest records should be dropped from history:", app.history[0].Id, app.history[2].Id)
+	}
+}
+
+func TestAppHistory(t *testing.T) {
+	app := newTestApp(t, &AppConfig{Command: "sleep 30"})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.StopInstances(-1, true); err != nil {
+		t.Fatal("Kill failed:", err)
+	}
+	waitFor(t, app, "instance killed", func() bool {
+		return len(app.history) == 1
+	})
+
+	history := app.History()
+	record := history[0]
+	if record.Id != 1 || record.Status != "killed" {
+		t.Error("Incorrect history record:", record.Id, record.Status)
+	}
+	if record.Signal != "killed" || record.ExitCode != -1 {
+		t.Error("Record should contain exit signal:", record.Signal, record.ExitCode)
+	}
+	if record.Ended < record.Started || record.Started == 0 {
+		t.Error("Record should contain start and end time:", record.Started, record.Ended)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+var ErrNoHeld = errors.New("No held instances")
+
+// hold starts a new set of instances that do not receive traffic until they
+// are promoted, running instances keep serving
+func (a *App) hold() error {
+	if a.fatal {
+		return ErrAppFatal
+	}
+	if a.rollout != nil {
+		a.abortRollout()
+	}
+	if len(a.held) > 0 {
+		a.discardHeld()
+	}
+
+	for i := 0; i < a.config.Replicas; i++ {
+		instance, err := a.startNewInstance(nil)
+		if err != nil {
+			a.discardHeld()
+			return err
+		}
+		instance.held = true
+		a.held = append(a.held, instance)
+	}
+
+	return nil
+}
+
+func (a *App) heldServing(instance *Instance) {
+	log.Printf("%s: Held instance %d is ready", a.config.Name, instance.id)
+	a.progressf("Held instance %d is ready", instance.id)
+}
+
+func (a *App) heldFailed(instance *Instance) {
+	held := []*Instance{}
+	for _, other := range a.held {
+		if other != instance {
+			held = append(held, other)
+		}
+	}
+	a.held = held
+	log.Printf("%s: Held instance %d failed", a.config.Name, instance.id)
+}
+
+// promoteHeld moves all traffic to held instances and stops the old ones
+func (a *App) promoteHeld() {
+	promoted := a.held
+	a.held = nil
+	a.replacing = nil
+
+	old := a.activeInstances
+	for _, instance := range promoted {
+		instance.held = false
+		instance.setActive(true)
+	}
+	a.setActiveInstances(promoted)
+
+	for _, instance := range old {
+		instance.setActive(false)
+	}
+	a.retire(old, promoted)
+	log.Printf("%s: Held instances promoted", a.config.Name)
+}
+
+// discardHeld stops held instances. They stay marked as held, so their exit
+// is not handled as failure of a serving instance.
+func (a *App) discardHeld() {
+	for _, instance := range a.held {
+		if instance.status == InstanceStatusServing || instance.status == InstanceStatusStarting {
+			instance.Stop()
+		}
+	}
+	a.held = nil
+}
+
+// Hold starts new instances without switching traffic to them
+func (a *App) Hold() error {
+	_, err := a.StartRestart(true)
+	return err
+}
+
+// Discard stops held instances instead of promoting them
+func (a *App) Discard() error {
+	var err error
+	a.do(func() {
+		if len(a.held) == 0 {
+			err = ErrNoHeld
+			return
+		}
+		log.Printf("%s: Held instances discarded", a.config.Name)
+		a.discardHeld()
+	})
+	return err
+}
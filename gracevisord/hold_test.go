@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestAppHold(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.Hold(); err != nil {
+		t.Fatal("Hold failed:", err)
+	}
+	waitFor(t, app, "held instance ready", func() bool {
+		return len(app.instances) == 2 && app.instances[1].Report().Status == "ready"
+	})
+	app.do(func() {
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 1 {
+			t.Error("Held instance should not receive traffic")
+		}
+	})
+
+	if err := app.Promote(); err != nil {
+		t.Fatal("Promote failed:", err)
+	}
+	app.do(func() {
+		if len(app.held) != 0 || app.instances[1].Report().Status != "serving" {
+			t.Error("Promote should clear held instances")
+		}
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 2 {
+			t.Error("Promote should move traffic to held instance")
+		}
+		if app.instances[0].status == InstanceStatusServing {
+			t.Error("Promote should stop old instance")
+		}
+	})
+}
+
+func TestAppDiscard(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+	})
+
+	if app.Discard() != ErrNoHeld {
+		t.Error("Discard should fail without held instances")
+	}
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+	if err := app.Hold(); err != nil {
+		t.Fatal("Hold failed:", err)
+	}
+	waitFor(t, app, "held instance ready", func() bool {
+		return len(app.held) == 1 && app.held[0].status == InstanceStatusServing
+	})
+
+	if err := app.Discard(); err != nil {
+		t.Fatal("Discard failed:", err)
+	}
+	waitFor(t, app, "held instance stopped", func() bool {
+		return app.instances[1].status == InstanceStatusStopped
+	})
+	app.do(func() {
+		if len(app.instances) != 2 || len(app.activeInstances) != 1 || app.activeInstances[0].id != 1 {
+			t.Error("Old instance should keep serving after discard")
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+const (
+	HookPreStart  = "pre_start"
+	HookPostStart = "post_start"
+	HookPreStop   = "pre_stop"
+	HookPostStop  = "post_stop"
+)
+
+// Hook is hook command prepared to run for instance
+type Hook struct {
+	name     string
+	instance *Instance
+	cmd      *exec.Cmd
+	timeout  time.Duration
+
+	stdout *hookWriter
+	stderr *hookWriter
+}
+
+// hook returns configured hook command or nil
+func (c *HooksConfig) hook(name string) *HookConfig {
+	if c == nil {
+		return nil
+	}
+	switch name {
+	case HookPreStart:
+		return c.PreStart
+	case HookPostStart:
+		return c.PostStart
+	case HookPreStop:
+		return c.PreStop
+	case HookPostStop:
+		return c.PostStop
+	}
+	return nil
+}
+
+// newHook prepares hook command with instance user, directory and
+// environment, returns nil if hook is not configured. Must be called from
+// the app supervisor.
+func (i *Instance) newHook(name string) *Hook {
+	config := i.config.Hooks.hook(name)
+	if config == nil {
+		return nil
+	}
+
+	logger := &InstanceLogger{instance: i}
+	hook := &Hook{
+		name:     name,
+		instance: i,
+		cmd:      i.command(config.Command),
+		timeout:  time.Duration(config.Timeout) * time.Second,
+		stdout:   &hookWriter{logger: logger, prefix: name, write: i.appLogger.logStdout},
+		stderr:   &hookWriter{logger: logger, prefix: name, write: i.appLogger.logStderr},
+	}
+	hook.cmd.Stdout = hook.stdout
+	hook.cmd.Stderr = hook.stderr
+
+	return hook
+}
+
+// Run runs hook command and writes its output to app logs
+func (h *Hook) Run() error {
+	err := runCommand(h.cmd, h.timeout)
+	h.stdout.flush()
+	h.stderr.flush()
+
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %s", h.name, err)
+	}
+	return nil
+}
+
+// runInBackground runs hook in background and logs its failure. Logger of
+// instance is kept open until the hook finishes.
+func (h *Hook) runInBackground() {
+	instance := h.instance
+	instance.hooks++
+	go func() {
+		if err := h.Run(); err != nil {
+			log.Printf("%s: Instance %d %s", instance.config.Name, instance.id, err)
+		}
+		instance.app.post(func() {
+			instance.hooks--
+			instance.app.closeRetiredLoggers()
+		})
+	}()
+}
+
+// preStart runs pre_start hook in background and reports its result to
+// supervisor
+func (i *Instance) preStart(hook *Hook) {
+	i.app.events <- &InstanceEvent{
+		instance: i,
+		event:    InstanceEventPreStarted,
+		hookErr:  hook.Run(),
+	}
+}
+
+// preStarted starts instance process after pre_start hook succeeded. When
+// the hook or the start failed, or instance was stopped meanwhile, instance
+// exits without running.
+func (a *App) preStarted(instance *Instance, err error) {
+	if err == nil && instance.status == InstanceStatusStarting {
+		if err = instance.launch(); err == nil {
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("%s: Instance %d %s", a.config.Name, instance.id, err)
+		instance.preStartFailed = true
+	}
+
+	a.handleEvent(&InstanceEvent{
+		instance:   instance,
+		event:      InstanceEventExited,
+		processErr: err,
+	})
+	close(instance.exited)
+}
+
+// preStartFailed aborts restart when new instance could not be started,
+// old instances keep serving
+func (a *App) preStartFailed(instance *Instance) {
+	instance.replaces = nil
+	a.replacing = nil
+	if a.progress != nil && !a.progress.done {
+		a.finishProgress(instance.processErr.Error())
+	}
+}
+
+// hookWriter splits hook command output to log lines
+type hookWriter struct {
+	logger *InstanceLogger
+	prefix string
+	write  func(*LogLine)
+
+	buf []byte
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		n := bytes.IndexByte(w.buf, '\n')
+		if n < 0 {
+			break
+		}
+		w.writeLine(bytes.TrimSuffix(w.buf[:n], []byte("\r")))
+		w.buf = w.buf[n+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes unfinished last line
+func (w *hookWriter) flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *hookWriter) writeLine(line []byte) {
+	ll, err := w.logger.newLogLine(append([]byte(w.prefix+": "), line...))
+	if err != nil {
+		log.Print(w.logger.instance.config.Name, ": Log write error:", err)
+		return
+	}
+	w.write(ll)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestInstanceHooks(t *testing.T) {
+	script := writeTestScript(t, "echo $1 $PORT\necho $1 error >&2\n")
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Hooks: &HooksConfig{
+			PreStart:  &HookConfig{Command: script + " pre"},
+			PostStart: &HookConfig{Command: script + " post"},
+			PreStop:   &HookConfig{Command: script + " pre"},
+			PostStop:  &HookConfig{Command: script + " post"},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	var port uint16
+	app.do(func() {
+		port = app.instances[0].internalPort
+	})
+
+	logged := func(lines ...string) func() bool {
+		return func() bool {
+			log, _ := ioutil.ReadFile(app.config.Logger.StdoutLogFile)
+			found := regexp.MustCompile(`\] (\w+: .*)`).FindAllStringSubmatch(string(log), -1)
+			hookLines := []string{}
+			for _, match := range found {
+				hookLines = append(hookLines, match[1])
+			}
+			return strings.Join(hookLines, "\n") == strings.Join(lines, "\n")
+		}
+	}
+
+	waitFor(t, app, "post_start hook", logged(
+		fmt.Sprintf("pre_start: pre %d", port),
+		fmt.Sprintf("post_start: post %d", port),
+	))
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "post_stop hook", logged(
+		fmt.Sprintf("pre_start: pre %d", port),
+		fmt.Sprintf("post_start: post %d", port),
+		fmt.Sprintf("pre_stop: pre %d", port),
+		fmt.Sprintf("post_stop: post %d", port),
+	))
+
+	stderr, _ := ioutil.ReadFile(app.config.Logger.StderrLogFile)
+	if !strings.Contains(string(stderr), "pre_start: pre error") {
+		t.Error("Hook stderr should be logged:", string(stderr))
+	}
+}
+
+func TestAppPreStartFailed(t *testing.T) {
+	script := writeTestScript(t, "test ! -f $1\n")
+	marker := path.Join(path.Dir(script), "fail")
+	app := newTestApp(t, &AppConfig{
+		Command:  "sleep 30",
+		Replicas: 2,
+		Hooks: &HooksConfig{
+			PreStart: &HookConfig{Command: script + " " + marker},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instances active", func() bool {
+		return len(app.activeInstances) == 2
+	})
+
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	id, err := app.StartRestart(false)
+	if err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "restart failed", func() bool {
+		return app.progress.done
+	})
+	if progress := app.Progress(id, 0); !strings.Contains(progress.Error, "pre_start hook failed") {
+		t.Error("Restart should fail when pre_start hook fails:", progress.Error)
+	}
+	app.do(func() {
+		if len(app.instances) != 3 || app.instances[2].status != InstanceStatusFailed {
+			t.Error("New instance should fail after failed pre_start hook")
+		}
+		if len(app.activeInstances) != 2 || len(app.replacing) != 0 || app.restartTimer != nil {
+			t.Error("Old instances should keep serving after failed pre_start hook")
+		}
+	})
+}
+
+func TestAppPreStartInBackground(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Hooks: &HooksConfig{
+			PreStart: &HookConfig{Command: "sleep 0.5"},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	// supervisor keeps handling commands while hook runs
+	app.do(func() {
+		if len(app.instances) != 1 || app.instances[0].status != InstanceStatusStarting || app.instances[0].cmd != nil {
+			t.Error("Instance should wait for pre_start hook")
+		}
+	})
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance stopped after hook", func() bool {
+		return app.instances[0].status == InstanceStatusStopped && app.instances[0].cmd == nil
+	})
+}
+
+func TestInstanceHookLogger(t *testing.T) {
+	script := writeTestScript(t, "sleep 0.5\necho $1\n")
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Hooks: &HooksConfig{
+			PostStop: &HookConfig{Command: script + " post"},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	// hooks of old instance log to app log it was started with
+	oldLog := app.config.Logger.StdoutLogFile
+	config := *app.Config()
+	logger := *config.Logger
+	logger.StdoutLogFile = path.Join(path.Dir(oldLog), "new.log")
+	logger.StderrLogFile = logger.StdoutLogFile
+	config.Logger = &logger
+	if err := app.Update(&config); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+	waitFor(t, app, "old logger closed after post_stop hook", func() bool {
+		return app.instances[0].terminated() && len(app.retiredLoggers) == 0
+	})
+
+	oldData, _ := ioutil.ReadFile(oldLog)
+	newData, _ := ioutil.ReadFile(logger.StdoutLogFile)
+	if !strings.Contains(string(oldData), "post_stop: post") || strings.Contains(string(newData), "post_stop") {
+		t.Error("Hook output should be written to log of its instance:", string(oldData), string(newData))
+	}
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/hamaxx/gracevisor/common/report"
 )
 
+var ErrCommandTimeout = errors.New("Command timed out")
+
 const (
 	InstanceStatusServing = iota
 	InstanceStatusStarting
@@ -27,31 +29,142 @@ const (
 )
 
 const (
-	HealthCheckTimeout = 1
-	PortBadge          = "{port}"
+	InstanceEventExited = iota
+	InstanceEventHealthy
+	InstanceEventStartTimeout
+	InstanceEventStopTimeout
+	InstanceEventUnhealthy
+	InstanceEventNotify
+	InstanceEventDrained
+	InstanceEventCheckFailed
+	InstanceEventPreStarted
+)
+
+const (
+	HealthCheckInterval = 100 * time.Millisecond
+	DrainCheckInterval  = 100 * time.Millisecond
+	PortBadge           = "{port}"
 )
 
+// InstanceEvent is pushed from instance goroutines to the app supervisor,
+// which is the only goroutine allowed to change instance state.
+type InstanceEvent struct {
+	instance *Instance
+	event    int
+
+	processExitState *os.ProcessState
+	processErr       error
+
+	notifyState  string
+	notifyStatus string
+
+	checkAttempt int
+	checkErr     error
+
+	hookErr error
+
+	stopSignal int
+}
+
 type Instance struct {
 	app *App
 	id  uint32
 
+	// config is app config instance was started with, it does not change
+	// when app config is reloaded
+	config *AppConfig
+
 	internalHost     string
 	internalPort     uint16
 	internalHostPort string
 	status           int
+	started          time.Time
 	lastChange       time.Time
-
-	connWg *sync.WaitGroup
-
+	servingSince     time.Time
+
+	// active is set while instance receives traffic, replaces is the
+	// instance that will be stopped when this one starts serving, canary
+	// is set while instance is part of a rollout, held while it waits to
+	// be promoted and shadowing while it gets copies of live requests
+	active    bool
+	canary    bool
+	held      bool
+	shadowing bool
+	replaces  *Instance
+
+	// lifecycleDone is closed when the last fired lifecycle hook finishes
+	lifecycleDone chan struct{}
+
+	// conns counts in-flight proxied connections, closers force close
+	// the ones still open when drain timeout expires
+	conns       int64
+	closers     map[uint64]func()
+	closersLock sync.Mutex
+	nextCloser  uint64
+
+	requests int64
+	errors   int64
+
+	proxyErrors            int64
+	consecutiveProxyErrors int64
+
+	// stdout and stderr are read ends of process output pipes
 	cmd              *exec.Cmd
+	stdout           *os.File
+	stderr           *os.File
 	processErr       error
 	processExitState *os.ProcessState
+	timedOut         bool
+
+	// preStartFailed is set when instance was not started because pre_start
+	// hook failed
+	preStartFailed bool
+
+	// unhealthy is set when liveness probe failed
+	unhealthy bool
+
+	// stopStep is the last stop sequence step that was started
+	stopStep int
+
+	// drains is number of drains in progress, stop sequence continues when
+	// the last one finishes
+	drains int
+
+	// hooks is number of hooks running in background
+	hooks int
+
+	// stopSignals counts sent stop signals, stop timeouts of signals sent
+	// before the last one are ignored
+	stopSignals int
+
+	// orphans are processes that were killed after instance was stopped
+	orphans []int
+
+	// ready is closed when instance signals readiness on notify socket or
+	// with ready pattern
+	ready        chan struct{}
+	readyOnce    sync.Once
+	notifySocket *NotifySocket
+	notifyState  string
+	notifyStatus string
+
+	// exited is closed after the process exit event was delivered and
+	// stopping is closed when instance stops serving
+	exited   chan struct{}
+	stopping chan struct{}
 
 	instanceLogger *InstanceLogger
+	appLogger      *AppLogger
 }
 
 func NewInstance(app *App, id uint32) (*Instance, error) {
-	port, err := app.portPool.ReserveNewPort()
+	var port uint16
+	var err error
+	if r := app.config.PortRange; r != nil {
+		port, err = app.portPool.ReservePortInRange(app.config.InternalHost, r.From, r.To)
+	} else {
+		port, err = app.portPool.ReserveNewPort(app.config.InternalHost)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -59,64 +172,129 @@ func NewInstance(app *App, id uint32) (*Instance, error) {
 	instance := &Instance{
 		id:               id,
 		app:              app,
+		config:           app.config,
 		internalHost:     app.config.InternalHost,
 		internalPort:     port,
 		internalHostPort: fmt.Sprintf("%s:%d", app.config.InternalHost, port),
 		status:           InstanceStatusStarting,
-		connWg:           &sync.WaitGroup{},
+		closers:          map[uint64]func(){},
+		started:          time.Now(),
 		lastChange:       time.Now(),
+		exited:           make(chan struct{}),
+		stopping:         make(chan struct{}),
+		ready:            make(chan struct{}),
+		appLogger:        app.appLogger,
 	}
 
-	cmdPath, cmdArgs := parseCommand(parsePortBadge(app.config.Command, port))
+	// process is started by supervisor after pre_start hook succeeds
+	if hook := instance.newHook(HookPreStart); hook != nil {
+		go instance.preStart(hook)
+		return instance, nil
+	}
 
-	cmd := exec.Command(cmdPath, cmdArgs...)
-	cmd.Dir = app.config.Directory
+	if err := instance.launch(); err != nil {
+		app.portPool.ReleasePort(port)
+		return nil, err
+	}
+	return instance, nil
+}
 
-	for _, env := range app.config.Environment {
-		cmd.Env = append(cmd.Env, parsePortBadge(env, port))
+// launch starts instance process and waits for it in background
+func (i *Instance) launch() error {
+	if err := i.start(); err != nil {
+		return err
 	}
 
-	// set credentials for setting uid
-	if app.config.User.Uid != 0 {
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Credential: &syscall.Credential{
-				Uid: app.config.User.Uid,
-			},
+	go i.waitProcess()
+	go i.waitHealthy()
+	return nil
+}
+
+func (i *Instance) start() error {
+	var err error
+	cmd := i.command(i.config.Command)
+
+	if i.config.Notify {
+		i.notifySocket, err = NewNotifySocket(i)
+		if err != nil {
+			return err
 		}
+		cmd.Env = append(cmd.Env, i.notifySocket.Env())
 	}
 
 	outPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	errPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = cmd.Start()
 	if err != nil {
-		return nil, err
+		if i.notifySocket != nil {
+			i.notifySocket.Close()
+		}
+		return err
 	}
 
-	instance.cmd = cmd
+	i.cmd = cmd
+	i.stdout = outPipe.(*os.File)
+	i.stderr = errPipe.(*os.File)
 
 	// init logger
-	instance.instanceLogger, err = NewInstanceLogger(instance, outPipe, errPipe)
-	if err != nil {
-		return nil, err
+	i.instanceLogger, err = NewInstanceLogger(i, outPipe, errPipe)
+	return err
+}
+
+// command prepares command to run with instance directory, environment and
+// user
+func (i *Instance) command(cmdLine string) *exec.Cmd {
+	cmdPath, cmdArgs := parseCommand(parsePortBadge(cmdLine, i.internalPort))
+
+	cmd := exec.Command(cmdPath, cmdArgs...)
+	cmd.Dir = i.config.Directory
+
+	for _, env := range i.config.Environment {
+		cmd.Env = append(cmd.Env, parsePortBadge(env, i.internalPort))
 	}
 
-	// wait for process to exit and update process state
-	go func() {
-		if instance.cmd.Process != nil {
-			state, err := instance.cmd.Process.Wait()
-			instance.processErr = err
-			instance.processExitState = state
+	// run in own process group, so signals reach all its processes
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// set credentials for setting uid
+	if i.config.User.Uid != 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid: i.config.User.Uid,
 		}
+	}
+
+	return cmd
+}
+
+// runCommand runs cmd and kills it if it does not finish before timeout
+func runCommand(cmd *exec.Cmd, timeout time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
 	}()
 
-	return instance, nil
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		killTree(cmd.Process.Pid)
+		<-done
+		return ErrCommandTimeout
+	}
 }
 
 func parsePortBadge(input string, port uint16) string {
@@ -128,142 +306,545 @@ func parseCommand(cmd string) (string, []string) {
 	return command[0], command[1:]
 }
 
+// sendEvent delivers an event to the app supervisor unless the process
+// has already exited, in which case the event is obsolete.
+func (i *Instance) sendEvent(event int) {
+	select {
+	case i.app.events <- &InstanceEvent{instance: i, event: event}:
+	case <-i.exited:
+	}
+}
+
+func (i *Instance) sendNotify(state, status string) {
+	event := &InstanceEvent{
+		instance:     i,
+		event:        InstanceEventNotify,
+		notifyState:  state,
+		notifyStatus: status,
+	}
+
+	select {
+	case i.app.events <- event:
+	case <-i.exited:
+	}
+}
+
+// sendCheckFailed reports failed health check attempt of starting instance
+func (i *Instance) sendCheckFailed(attempt int, err error) {
+	event := &InstanceEvent{
+		instance:     i,
+		event:        InstanceEventCheckFailed,
+		checkAttempt: attempt,
+		checkErr:     err,
+	}
+
+	select {
+	case i.app.events <- event:
+	case <-i.exited:
+	}
+}
+
+// markReady is called when instance signals its readiness
+func (i *Instance) markReady() {
+	i.readyOnce.Do(func() {
+		close(i.ready)
+	})
+}
+
+// isReady returns true if instance already signaled readiness
+func (i *Instance) isReady() bool {
+	select {
+	case <-i.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitProcess waits for process to exit and reports its exit state
+func (i *Instance) waitProcess() {
+	state, err := i.cmd.Process.Wait()
+	if i.notifySocket != nil {
+		i.notifySocket.Close()
+	}
+	i.app.events <- &InstanceEvent{
+		instance:         i,
+		event:            InstanceEventExited,
+		processExitState: state,
+		processErr:       err,
+	}
+	close(i.exited)
+}
+
+// waitHealthy waits for readiness signal if configured and then polls
+// health check until it passes or start timeout expires. Healthy instance
+// is warmed up before it is reported.
+func (i *Instance) waitHealthy() {
+	var timeout <-chan time.Time
+	if i.config.StartTimeout > 0 {
+		timer := time.NewTimer(time.Duration(i.config.StartTimeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	if i.config.Notify || i.config.ReadyPattern != "" {
+		select {
+		case <-i.ready:
+		case <-timeout:
+			i.sendEvent(InstanceEventStartTimeout)
+			return
+		case <-i.exited:
+			return
+		}
+	}
+
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+
+	attempts := 0
+	var lastReport time.Time
+	for {
+		err := i.checkHealth(0)
+		if err == nil {
+			break
+		}
+		attempts++
+		if time.Since(lastReport) >= HealthCheckReportInterval {
+			lastReport = time.Now()
+			i.sendCheckFailed(attempts, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			i.sendEvent(InstanceEventStartTimeout)
+			return
+		case <-i.exited:
+			return
+		}
+	}
+
+	if len(i.config.Warmup) > 0 {
+		warmedUp := make(chan struct{})
+		go func() {
+			i.warmup()
+			close(warmedUp)
+		}()
+
+		select {
+		case <-warmedUp:
+		case <-timeout:
+			i.sendEvent(InstanceEventStartTimeout)
+			return
+		case <-i.exited:
+			return
+		}
+	}
+
+	i.sendEvent(InstanceEventHealthy)
+}
+
+// probeLiveness periodically checks serving instance and reports it as
+// unhealthy after too many consecutive failures
+func (i *Instance) probeLiveness() {
+	config := i.config.Liveness
+
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	failures := 0
+	successes := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-i.stopping:
+			return
+		case <-i.exited:
+			return
+		}
+
+		if i.healthCheck(time.Duration(config.Timeout) * time.Second) {
+			successes++
+			if successes >= config.SuccessThreshold {
+				failures = 0
+			}
+			continue
+		}
+
+		successes = 0
+		failures++
+		if failures == config.FailureThreshold {
+			log.Printf("%s: Instance %d failed %d liveness probes", i.config.Name, i.id, failures)
+			i.sendEvent(InstanceEventUnhealthy)
+		}
+	}
+}
+
+func (i *Instance) setStatus(status int) {
+	if status != i.status {
+		if status == InstanceStatusStopping {
+			close(i.stopping)
+		}
+		if i.app != nil && (status == InstanceStatusServing || i.status == InstanceStatusServing) {
+			i.app.setServing(i, status == InstanceStatusServing)
+		}
+		i.status = status
+		i.lastChange = time.Now()
+		if i.app != nil {
+			i.app.instanceProgress(i, status)
+		}
+	}
+}
+
 func (i *Instance) Stop() {
-	i.status = InstanceStatusStopping
-	i.lastChange = time.Now()
+	// repeated stop drains instance again and resends signal of current
+	// stop step
+	if i.status == InstanceStatusStopping && i.stopStep > 0 {
+		i.stopStep--
+	}
+	// pre_stop and drained hooks are only called for instances that
+	// received traffic
+	var preStop *Hook
+	var drainedHook *LifecycleHookConfig
+	if i.status == InstanceStatusServing {
+		preStop = i.newHook(HookPreStop)
+		drainedHook = i.config.Lifecycle.hook(LifecycleDrained)
+	}
+	prevHook := i.lifecycleDone
+	i.setStatus(InstanceStatusStopping)
+	if i.cmd == nil {
+		// pre_start hook is running, process will not be started
+		return
+	}
 
-	// wait for all http requests to finish
+	// wait for all proxied connections to finish
+	i.drains++
 	go func() {
-		i.connWg.Wait()
-		if i.cmd.Process != nil {
-			if err := i.cmd.Process.Signal(i.app.config.StopSignal); err != nil {
-				log.Print("Stop signal error:", err)
-				return
+		if preStop != nil {
+			if err := preStop.Run(); err != nil {
+				log.Printf("%s: Instance %d %s", i.config.Name, i.id, err)
+			}
+		}
+		i.drain()
+		if drainedHook != nil {
+			if prevHook != nil {
+				<-prevHook
 			}
+			i.callLifecycle(LifecycleDrained, drainedHook)
 		}
+		i.sendEvent(InstanceEventDrained)
 	}()
+}
+
+// drain waits for in-flight connections to finish, connections still open
+// when drain timeout expires are force closed
+func (i *Instance) drain() {
+	var timeout <-chan time.Time
+	if i.config.DrainTimeout > 0 {
+		timer := time.NewTimer(time.Duration(i.config.DrainTimeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 
+	ticker := time.NewTicker(DrainCheckInterval)
+	defer ticker.Stop()
+
+	for i.Conns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			closed := i.closeConns()
+			log.Printf("%s: Drain timeout expired, closed %d connections to instance %d", i.config.Name, closed, i.id)
+			return
+		}
+	}
+}
+
+// nextStopStep sends signal of next stop sequence step, instance is killed
+// when the last step times out
+func (i *Instance) nextStopStep() {
+	sequence := i.config.stopSequence
+	if i.stopStep >= len(sequence) {
+		i.kill()
+		return
+	}
+
+	step := sequence[i.stopStep]
+	i.stopStep++
+	if err := signalGroup(i.cmd.Process.Pid, step.Signal); err != nil {
+		log.Print("Stop signal error:", err)
+		return
+	}
+	i.stopSignals++
+	if step.Timeout > 0 {
+		go i.waitStopTimeout(i.stopSignals, time.Duration(step.Timeout)*time.Second)
+	}
+}
+
+// waitStopTimeout reports stop timeout of n-th stop signal if instance does
+// not exit in time
+func (i *Instance) waitStopTimeout(n int, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		select {
+		case i.app.events <- &InstanceEvent{instance: i, event: InstanceEventStopTimeout, stopSignal: n}:
+		case <-i.exited:
+		}
+	case <-i.exited:
+	}
 }
 
 func (i *Instance) Kill() {
-	i.status = InstanceStatusStopping
-	i.lastChange = time.Now()
-	if i.cmd.Process != nil {
-		i.processErr = i.cmd.Process.Kill()
+	i.setStatus(InstanceStatusStopping)
+	i.kill()
+}
+
+// kill kills whole process tree of instance, including processes that
+// escaped its process group
+func (i *Instance) kill() {
+	if i.cmd == nil {
+		return
 	}
+	escaped, err := killTree(i.cmd.Process.Pid)
+	if err != nil {
+		log.Print("Kill error:", err)
+	}
+	if len(escaped) > 0 {
+		log.Printf("%s: Killed processes %v of instance %d that escaped its process group", i.config.Name, escaped, i.id)
+		i.orphans = append(i.orphans, escaped...)
+	}
+}
+
+// killLeftovers kills processes left in process group after instance
+// process exited
+func (i *Instance) killLeftovers() {
+	pid := i.cmd.Process.Pid
+	leftovers := groupMembers(readProcesses(), pid)
+	if len(leftovers) == 0 {
+		return
+	}
+	syscall.Kill(-pid, syscall.SIGKILL)
+	log.Printf("%s: Killed processes %v left behind by instance %d", i.config.Name, leftovers, i.id)
+	i.orphans = append(i.orphans, leftovers...)
 }
 
-// Serve registers active http request
+// Serve registers active connection
 func (i *Instance) Serve() {
-	i.connWg.Add(1)
+	atomic.AddInt64(&i.conns, 1)
 }
 
-// Done finishes active http request
+// Done finishes active connection
 func (i *Instance) Done() {
-	i.connWg.Done()
+	atomic.AddInt64(&i.conns, -1)
 }
 
-func (i *Instance) healthCheck() bool {
-	if i.app.config.HealthCheck == "" {
-		return true
-	}
+// Track registers func that force closes active connection when drain
+// timeout expires, returned func unregisters it
+func (i *Instance) Track(closer func()) (untrack func()) {
+	i.closersLock.Lock()
+	defer i.closersLock.Unlock()
 
-	healthCheckUrl := url.URL{
-		Scheme: "http",
-		Host:   i.internalHostPort,
-		Path:   i.app.config.HealthCheck,
-	}
+	i.nextCloser++
+	id := i.nextCloser
+	i.closers[id] = closer
 
-	resp, err := http.Get(healthCheckUrl.String())
-	if err != nil || resp.StatusCode != 200 {
-		return false
+	return func() {
+		i.closersLock.Lock()
+		delete(i.closers, id)
+		i.closersLock.Unlock()
 	}
-	if err := resp.Body.Close(); err != nil {
-		log.Print(err)
+}
+
+// closeConns force closes tracked connections and returns their number
+func (i *Instance) closeConns() int {
+	i.closersLock.Lock()
+	closers := i.closers
+	i.closers = map[uint64]func(){}
+	i.closersLock.Unlock()
+
+	for _, closer := range closers {
+		closer()
 	}
+	return len(closers)
+}
 
-	return true
+// RecordRequest counts proxied request and whether it failed
+func (i *Instance) RecordRequest(failed bool) {
+	atomic.AddInt64(&i.requests, 1)
+	if failed {
+		atomic.AddInt64(&i.errors, 1)
+	}
 }
 
-func (i *Instance) checkProcessStartupStatus() int {
-	if i.processExitState != nil || i.processErr != nil {
-		log.Print("Process exited on startup", i.processErr, i.processExitState)
-		return InstanceStatusFailed
+// ProxyError counts failed connection or round trip to instance. Instance is
+// reported as unhealthy after too many consecutive failures.
+func (i *Instance) ProxyError() {
+	atomic.AddInt64(&i.proxyErrors, 1)
+	consecutive := atomic.AddInt64(&i.consecutiveProxyErrors, 1)
+
+	if maxErrors := i.config.MaxProxyErrors; maxErrors > 0 && consecutive == int64(maxErrors) {
+		log.Printf("%s: Instance %d failed %d proxied requests in a row", i.config.Name, i.id, consecutive)
+		go i.sendEvent(InstanceEventUnhealthy)
 	}
+}
 
-	if i.app.config.StartTimeout > 0 && time.Since(i.lastChange) > time.Duration(i.app.config.StartTimeout)*time.Second {
-		if i.cmd.Process != nil {
-			i.processErr = i.cmd.Process.Kill()
-		}
-		return InstanceStatusTimedOut
+// ProxySuccess resets consecutive proxy errors
+func (i *Instance) ProxySuccess() {
+	if atomic.LoadInt64(&i.consecutiveProxyErrors) != 0 {
+		atomic.StoreInt64(&i.consecutiveProxyErrors, 0)
 	}
+}
 
-	if i.cmd.Process == nil {
-		return InstanceStatusStarting
+func (i *Instance) RequestCounters() requestCounters {
+	return requestCounters{
+		requests: atomic.LoadInt64(&i.requests),
+		errors:   atomic.LoadInt64(&i.errors),
 	}
+}
+
+// Conns returns number of active connections
+func (i *Instance) Conns() int64 {
+	return atomic.LoadInt64(&i.conns)
+}
+
+func (i *Instance) healthCheck(timeout time.Duration) bool {
+	return i.checkHealth(timeout) == nil
+}
 
-	if i.healthCheck() {
-		return InstanceStatusServing
+func (i *Instance) checkHealth(timeout time.Duration) error {
+	if i.config.HealthCheck == nil {
+		return nil
 	}
-	return InstanceStatusStarting
+	return i.config.HealthCheck.Check(i, timeout)
 }
 
-func (i *Instance) checkProcessStoppingStatus() int {
-	if i.processErr != nil || i.cmd.Process == nil {
-		log.Print(i.processErr)
-		return InstanceStatusExited
+func (i *Instance) killedBySignal() bool {
+	if i.processExitState == nil {
+		return false
+	}
+	if ws, ok := i.processExitState.Sys().(syscall.WaitStatus); ok {
+		return ws.Signaled() && ws.Signal() == syscall.SIGKILL
 	}
-	if i.processExitState != nil {
-		if s, ok := i.processExitState.Sys().(int); ok && s == 9 {
+	return false
+}
+
+func (i *Instance) exitStatus() int {
+	switch i.status {
+	case InstanceStatusStarting:
+		if i.preStartFailed {
+			return InstanceStatusFailed
+		}
+		log.Print("Process exited on startup", i.processErr, i.processExitState)
+		if i.timedOut {
+			return InstanceStatusTimedOut
+		}
+		return InstanceStatusFailed
+	case InstanceStatusStopping:
+		if i.processErr != nil {
+			log.Print(i.processErr)
+			return InstanceStatusExited
+		}
+		if i.killedBySignal() {
 			return InstanceStatusKilled
 		}
 		return InstanceStatusStopped
+	case InstanceStatusServing:
+		log.Printf("%s:%s", i.processExitState, i.processErr)
+		return InstanceStatusExited
 	}
+	return i.status
+}
 
-	if i.app.config.StopTimeout > 0 && time.Since(i.lastChange) > time.Duration(i.app.config.StopTimeout)*time.Second {
-		i.processErr = i.cmd.Process.Kill()
-		return InstanceStatusKilled
+// exitedWithError returns true unless instance exited cleanly while serving
+func (i *Instance) exitedWithError() bool {
+	if i.status != InstanceStatusExited {
+		return true
 	}
-
-	return InstanceStatusStopping
+	return i.processErr != nil || !i.processExitState.Success()
 }
 
-func (i *Instance) checkProcessRunningStatus() int {
-	if i.processErr != nil || i.cmd.Process == nil || i.processExitState != nil {
-		log.Printf("%s:%s", i.processExitState, i.processErr)
-		return InstanceStatusExited
+// servedFor returns how long instance was serving before it exited
+func (i *Instance) servedFor() time.Duration {
+	if i.servingSince.IsZero() {
+		return 0
 	}
-
-	return InstanceStatusServing
+	return i.lastChange.Sub(i.servingSince)
 }
 
-// UpdateStatus is called from app every second for status update
-func (i *Instance) UpdateStatus() int {
-	if i.status == InstanceStatusStarting {
-		status := i.checkProcessStartupStatus()
-		if status != i.status {
-			i.status = status
-			i.lastChange = time.Now()
+// HandleEvent applies instance event to instance state. It must only be
+// called from the app supervisor. Returns true if status was changed.
+func (i *Instance) HandleEvent(event *InstanceEvent) bool {
+	prevStatus := i.status
+
+	switch event.event {
+	case InstanceEventHealthy:
+		if i.status == InstanceStatusStarting {
+			i.setStatus(InstanceStatusServing)
+			i.servingSince = i.lastChange
+			if hook := i.newHook(HookPostStart); hook != nil {
+				hook.runInBackground()
+			}
+			if i.config.Liveness != nil {
+				go i.probeLiveness()
+			}
 		}
-	} else if i.status == InstanceStatusStopping {
-		status := i.checkProcessStoppingStatus()
-		if status != i.status {
-			i.status = status
-			i.lastChange = time.Now()
+	case InstanceEventStartTimeout:
+		if i.status == InstanceStatusStarting {
+			i.timedOut = true
+			i.kill()
 		}
-	} else if i.status == InstanceStatusServing {
-		status := i.checkProcessRunningStatus()
-		if status != i.status {
-			i.status = status
-			i.lastChange = time.Now()
+	case InstanceEventDrained:
+		i.drains--
+		if i.status == InstanceStatusStopping && i.drains <= 0 {
+			i.drains = 0
+			i.nextStopStep()
+		}
+	case InstanceEventStopTimeout:
+		// signal is resent after repeated stop drains instance again
+		if i.status == InstanceStatusStopping && event.stopSignal == i.stopSignals && i.drains == 0 {
+			i.nextStopStep()
+		}
+	case InstanceEventUnhealthy:
+		if i.status == InstanceStatusServing && !i.unhealthy {
+			i.unhealthy = true
+			return true
+		}
+	case InstanceEventNotify:
+		if event.notifyState != "" {
+			i.notifyState = event.notifyState
+		}
+		if event.notifyStatus != "" {
+			i.notifyStatus = event.notifyStatus
+		}
+	case InstanceEventExited:
+		i.processExitState = event.processExitState
+		i.processErr = event.processErr
+		i.setStatus(i.exitStatus())
+		if i.cmd == nil {
+			// process was never started
+			break
+		}
+		i.killLeftovers()
+		if hook := i.newHook(HookPostStop); hook != nil {
+			hook.runInBackground()
 		}
 	}
-	return i.status
+
+	return i.status != prevStatus
 }
 
 func (i *Instance) StatusString() string {
 	switch i.status {
 	case InstanceStatusServing:
+		if i.held {
+			return "ready"
+		}
+		if i.shadowing {
+			return "shadowing"
+		}
 		return "serving"
 	case InstanceStatusStarting:
 		return "starting"
@@ -285,12 +866,28 @@ func (i *Instance) StatusString() string {
 
 func (i *Instance) Report() *report.Instance {
 	instanceReport := &report.Instance{
-		Id:                i.id,
-		Active:            i == i.app.activeInstance,
-		Host:              i.internalHost,
-		Port:              i.internalPort,
-		Status:            i.StatusString(),
-		SinceStatusChange: uint64(time.Since(i.lastChange) / time.Second),
+		Id:           i.id,
+		Active:       i.active,
+		Canary:       i.canary,
+		Unhealthy:    i.unhealthy,
+		NotifyState:  i.notifyState,
+		NotifyStatus: i.notifyStatus,
+
+		ProxyErrors:            uint64(atomic.LoadInt64(&i.proxyErrors)),
+		ConsecutiveProxyErrors: uint64(atomic.LoadInt64(&i.consecutiveProxyErrors)),
+		Host:                   i.internalHost,
+		Port:                   i.internalPort,
+		Status:                 i.StatusString(),
+		SinceStatusChange:      uint64(time.Since(i.lastChange) / time.Second),
+		Orphans:                i.orphans,
+		InFlight:               i.Conns(),
+	}
+
+	if i.status == InstanceStatusStopping && i.stopStep > 0 {
+		step := i.config.stopSequence[i.stopStep-1]
+		instanceReport.StopStep = i.stopStep
+		instanceReport.StopSteps = len(i.config.stopSequence)
+		instanceReport.StopSignal = step.SignalName
 	}
 
 	if i.processErr != nil {
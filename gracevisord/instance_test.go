@@ -1,16 +1,86 @@
 package main
 
 import (
-	"sync"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 )
 
 func BenchmarkServe(b *testing.B) {
 	inst := &Instance{}
-	inst.connWg = &sync.WaitGroup{}
 
 	for i := 0; i < b.N; i++ {
 		inst.Serve()
 		inst.Done()
 	}
 }
+
+// newTestServer listens on instance port and responds with status returned
+// by status func
+func newTestServer(t *testing.T, instance *Instance, status func() int) *httptest.Server {
+	return newTestHandlerServer(t, instance, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status())
+	})
+}
+
+// newTestHandlerServer listens on instance port and serves requests with
+// handler
+func newTestHandlerServer(t *testing.T, instance *Instance, handler http.HandlerFunc) *httptest.Server {
+	listener, err := net.Listen("tcp", instance.internalHostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestInstanceLiveness(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:     "sleep 30",
+		HealthCheck: &HealthCheckConfig{Path: "/health"},
+		Liveness: &LivenessConfig{
+			Interval:         1,
+			FailureThreshold: 1,
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+
+	var instance *Instance
+	app.do(func() {
+		instance = app.instances[0]
+	})
+	healthy := int32(1)
+	newTestServer(t, instance, func() int {
+		if atomic.LoadInt32(&healthy) == 1 {
+			return http.StatusOK
+		}
+		return http.StatusInternalServerError
+	})
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	atomic.StoreInt32(&healthy, 0)
+	waitFor(t, app, "instance unhealthy", func() bool {
+		return app.instances[0].unhealthy
+	})
+	app.do(func() {
+		if len(app.instances) != 2 || app.instances[1].replaces != app.instances[0] {
+			t.Error("Unhealthy instance should be replaced")
+		}
+		if !app.instances[0].active {
+			t.Error("Unhealthy instance should serve until replacement is ready")
+		}
+	})
+}
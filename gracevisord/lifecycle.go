@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	LifecycleActive   = "active"
+	LifecycleInactive = "inactive"
+	LifecycleDrained  = "drained"
+)
+
+// hook returns configured hook of lifecycle event or nil
+func (c *LifecycleConfig) hook(event string) *LifecycleHookConfig {
+	if c == nil {
+		return nil
+	}
+	switch event {
+	case LifecycleActive:
+		return c.Active
+	case LifecycleInactive:
+		return c.Inactive
+	case LifecycleDrained:
+		return c.Drained
+	}
+	return nil
+}
+
+// Call notifies instance about lifecycle event
+func (c *LifecycleHookConfig) Call(instance *Instance, event string) error {
+	if c.SignalName != "" {
+		return instance.cmd.Process.Signal(c.Signal)
+	}
+
+	hookUrl := url.URL{
+		Scheme: "http",
+		Host:   instance.internalHostPort,
+		Path:   c.Path,
+	}
+
+	req, err := http.NewRequest(c.Method, hookUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Gracevisor-Event", event)
+
+	client := &http.Client{Timeout: time.Duration(c.Timeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected lifecycle hook status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setActive marks instance as receiving traffic and fires active or inactive
+// lifecycle hook when it changes
+func (i *Instance) setActive(active bool) {
+	if i.active == active {
+		return
+	}
+	i.active = active
+
+	if active {
+		i.fireLifecycle(LifecycleActive)
+	} else {
+		i.fireLifecycle(LifecycleInactive)
+	}
+}
+
+// fireLifecycle calls lifecycle hook in background, hooks of instance are
+// called in the order they were fired
+func (i *Instance) fireLifecycle(event string) {
+	hook := i.config.Lifecycle.hook(event)
+	if hook == nil || i.terminated() {
+		return
+	}
+
+	prev := i.lifecycleDone
+	done := make(chan struct{})
+	i.lifecycleDone = done
+
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		i.callLifecycle(event, hook)
+	}()
+}
+
+func (i *Instance) callLifecycle(event string, hook *LifecycleHookConfig) {
+	if err := hook.Call(i, event); err != nil {
+		log.Printf("%s: Lifecycle hook %s of instance %d failed: %s", i.config.Name, event, i.id, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInstanceLifecycleHooks(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:     "sleep 30",
+		HealthCheck: &HealthCheckConfig{Path: "/health"},
+		Lifecycle: &LifecycleConfig{
+			Active:   &LifecycleHookConfig{Path: "/hooks/active"},
+			Inactive: &LifecycleHookConfig{Path: "/hooks/inactive"},
+			Drained:  &LifecycleHookConfig{Path: "/hooks/drained", Method: "PUT"},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+
+	var instance *Instance
+	app.do(func() {
+		instance = app.instances[0]
+	})
+
+	var lock sync.Mutex
+	calls := []string{}
+	listener, err := net.Listen("tcp", instance.internalHostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/hooks/") {
+			lock.Lock()
+			calls = append(calls, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Gracevisor-Event"))
+			lock.Unlock()
+		}
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance stopped", func() bool {
+		return instance.status == InstanceStatusStopped
+	})
+
+	expected := []string{
+		"POST /hooks/active active",
+		"POST /hooks/inactive inactive",
+		"PUT /hooks/drained drained",
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Error("Lifecycle hooks should be called in order:", calls)
+	}
+}
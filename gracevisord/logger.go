@@ -36,34 +36,34 @@ func (ll *LogLine) WriteTo(w io.Writer) error {
 }
 
 type AppLogger struct {
-	app *App
+	config *AppConfig
 
 	stdoutWriter io.WriteCloser
 	stderrWriter io.WriteCloser
 }
 
-func NewAppLogger(app *App) *AppLogger {
+func NewAppLogger(config *AppConfig) *AppLogger {
 	stdoutWriter := &lumberjack.Logger{
-		Filename:   app.config.Logger.StdoutLogFile,
-		MaxSize:    app.config.Logger.MaxLogSize,
-		MaxAge:     app.config.Logger.MaxLogAge,
-		MaxBackups: app.config.Logger.MaxLogsKept,
+		Filename:   config.Logger.StdoutLogFile,
+		MaxSize:    config.Logger.MaxLogSize,
+		MaxAge:     config.Logger.MaxLogAge,
+		MaxBackups: config.Logger.MaxLogsKept,
 	}
 
 	var stderrWriter io.WriteCloser
-	if app.config.Logger.StdoutLogFile == app.config.Logger.StderrLogFile {
+	if config.Logger.StdoutLogFile == config.Logger.StderrLogFile {
 		stderrWriter = stdoutWriter
 	} else {
 		stderrWriter = &lumberjack.Logger{
-			Filename:   app.config.Logger.StderrLogFile,
-			MaxSize:    app.config.Logger.MaxLogSize,
-			MaxAge:     app.config.Logger.MaxLogAge,
-			MaxBackups: app.config.Logger.MaxLogsKept,
+			Filename:   config.Logger.StderrLogFile,
+			MaxSize:    config.Logger.MaxLogSize,
+			MaxAge:     config.Logger.MaxLogAge,
+			MaxBackups: config.Logger.MaxLogsKept,
 		}
 	}
 
 	return &AppLogger{
-		app:          app,
+		config:       config,
 		stdoutWriter: stdoutWriter,
 		stderrWriter: stderrWriter,
 	}
@@ -71,19 +71,50 @@ func NewAppLogger(app *App) *AppLogger {
 
 func (al *AppLogger) logStdout(logLine *LogLine) {
 	if err := logLine.WriteTo(al.stdoutWriter); err != nil {
-		log.Print(al.app.config.Name, ": Stdout write error:", err)
+		log.Print(al.config.Name, ": Stdout write error:", err)
 	}
 	logLinePool.Put(logLine)
 }
 
 func (al *AppLogger) logStderr(logLine *LogLine) {
 	if err := logLine.WriteTo(al.stderrWriter); err != nil {
-		log.Print(al.app.config.Name, ": Stderr write error:", err)
+		log.Print(al.config.Name, ": Stderr write error:", err)
 	}
 
 	logLinePool.Put(logLine)
 }
 
+func (al *AppLogger) Close() {
+	if err := al.stdoutWriter.Close(); err != nil {
+		log.Print(al.config.Name, ": Stdout close error:", err)
+	}
+	if al.stderrWriter != al.stdoutWriter {
+		if err := al.stderrWriter.Close(); err != nil {
+			log.Print(al.config.Name, ": Stderr close error:", err)
+		}
+	}
+}
+
+// closeRetiredLoggers closes replaced app loggers that are not used by any
+// running instance or its hooks anymore
+func (a *App) closeRetiredLoggers() {
+	retired := a.retiredLoggers[:0]
+	for _, logger := range a.retiredLoggers {
+		used := false
+		for _, instance := range a.instances {
+			if instance.appLogger == logger && (!instance.terminated() || instance.hooks > 0) {
+				used = true
+			}
+		}
+		if used {
+			retired = append(retired, logger)
+		} else {
+			logger.Close()
+		}
+	}
+	a.retiredLoggers = retired
+}
+
 type InstanceLogger struct {
 	instance *Instance
 }
@@ -93,8 +124,8 @@ func NewInstanceLogger(instance *Instance, outPipe, errPipe io.ReadCloser) (*Ins
 		instance: instance,
 	}
 
-	il.lineReader(outPipe, instance.app.appLogger.logStdout)
-	il.lineReader(errPipe, instance.app.appLogger.logStderr)
+	il.lineReader(outPipe, instance.appLogger.logStdout)
+	il.lineReader(errPipe, instance.appLogger.logStderr)
 
 	return il, nil
 }
@@ -107,7 +138,7 @@ func (il *InstanceLogger) lineReader(pipe io.ReadCloser, writer func(*LogLine))
 			if err == io.EOF {
 				return
 			} else if err != nil {
-				log.Print(il.instance.app.config.Name, ": Read Error:", err)
+				log.Print(il.instance.config.Name, ": Read Error:", err)
 				return
 			}
 			if len(line) > 0 && line[len(line)-1] == '\n' {
@@ -116,9 +147,14 @@ func (il *InstanceLogger) lineReader(pipe io.ReadCloser, writer func(*LogLine))
 			if len(line) > 0 && line[len(line)-1] == '\r' {
 				line = line[0 : len(line)-1]
 			}
+			if readyPattern := il.instance.config.readyPattern; readyPattern != nil && !il.instance.isReady() {
+				if readyPattern.Match(line) {
+					il.instance.markReady()
+				}
+			}
 			ll, err := il.newLogLine(line)
 			if err != nil {
-				log.Print(il.instance.app.config.Name, ": Log write error:", err)
+				log.Print(il.instance.config.Name, ": Log write error:", err)
 				continue
 			}
 			writer(ll)
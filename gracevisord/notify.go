@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	NotifyStateReady    = "ready"
+	NotifyStateStopping = "stopping"
+
+	notifyMaxMessageSize = 4096
+)
+
+// NotifySocket is sd_notify compatible socket on which instance can signal
+// its readiness
+type NotifySocket struct {
+	instance *Instance
+	path     string
+	conn     *net.UnixConn
+}
+
+// NewNotifySocket binds socket in a new private directory, so its path
+// cannot be taken over by other users
+func NewNotifySocket(instance *Instance) (*NotifySocket, error) {
+	dir, err := ioutil.TempDir("", fmt.Sprintf("gracevisor-%s-%d-", instance.config.Name, instance.id))
+	if err != nil {
+		return nil, err
+	}
+	socketPath := path.Join(dir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+
+	// app may run as a different user
+	if uid := instance.config.User.Uid; uid != 0 {
+		for _, name := range []string{dir, socketPath} {
+			if err := os.Lchown(name, int(uid), -1); err != nil {
+				conn.Close()
+				os.RemoveAll(dir)
+				return nil, err
+			}
+		}
+	}
+
+	ns := &NotifySocket{
+		instance: instance,
+		path:     socketPath,
+		conn:     conn,
+	}
+	go ns.read()
+
+	return ns, nil
+}
+
+// AdoptNotifySocket creates notify socket from inherited socket file
+func AdoptNotifySocket(instance *Instance, socketPath string, file *os.File) (*NotifySocket, error) {
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ns := &NotifySocket{
+		instance: instance,
+		path:     socketPath,
+		conn:     conn.(*net.UnixConn),
+	}
+	go ns.read()
+
+	return ns, nil
+}
+
+func (ns *NotifySocket) read() {
+	buf := make([]byte, notifyMaxMessageSize)
+	for {
+		n, _, err := ns.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			switch {
+			case line == "READY=1":
+				ns.instance.markReady()
+				ns.instance.sendNotify(NotifyStateReady, "")
+			case line == "STOPPING=1":
+				ns.instance.sendNotify(NotifyStateStopping, "")
+			case strings.HasPrefix(line, "STATUS="):
+				ns.instance.sendNotify("", strings.TrimPrefix(line, "STATUS="))
+			}
+		}
+	}
+}
+
+func (ns *NotifySocket) Env() string {
+	return "NOTIFY_SOCKET=" + ns.path
+}
+
+func (ns *NotifySocket) Close() {
+	if err := ns.conn.Close(); err != nil {
+		log.Print(ns.instance.config.Name, ": Notify socket close error:", err)
+	}
+	os.Remove(ns.path)
+	os.Remove(path.Dir(ns.path))
+}
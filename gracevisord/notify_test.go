@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestInstanceNotify(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Notify:  true,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+
+	var socketPath string
+	app.do(func() {
+		socketPath = app.instances[0].notifySocket.path
+	})
+	if stat, err := os.Stat(path.Dir(socketPath)); err != nil || stat.Mode().Perm() != 0700 {
+		t.Error("Notify socket should be in private directory:", stat.Mode(), err)
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal("Dial notify socket failed:", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("STATUS=warming up")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, app, "notify status", func() bool {
+		return app.instances[0].notifyStatus == "warming up"
+	})
+	app.do(func() {
+		if app.instances[0].status != InstanceStatusStarting {
+			t.Error("Instance should not serve before READY=1")
+		}
+	})
+
+	if _, err := conn.Write([]byte("STATUS=ready\nREADY=1")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	report := app.Report(1).Instances[0]
+	if report.NotifyState != NotifyStateReady || report.NotifyStatus != "ready" {
+		t.Error("Notify state should be reported:", report.NotifyState, report.NotifyStatus)
+	}
+
+	if err := app.StopInstances(-1, true); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance killed", func() bool {
+		return app.instances[0].terminated()
+	})
+	if _, err := os.Stat(path.Dir(socketPath)); !os.IsNotExist(err) {
+		t.Error("Notify socket directory should be removed:", err)
+	}
+}
+
+func TestInstanceReadyPattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := path.Join(dir, "app.sh")
+	data := "#!/bin/sh\necho starting\nsleep 0.5\necho listening on $PORT\nexec sleep 30\n"
+	if err := ioutil.WriteFile(script, []byte(data), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t, &AppConfig{
+		Command:      script,
+		ReadyPattern: "^listening on [0-9]+$",
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	app.do(func() {
+		if app.instances[0].status != InstanceStatusStarting {
+			t.Error("Instance should not serve before ready pattern is matched")
+		}
+	})
+
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"sync"
 )
 
 var ErrNoAvailablePorts = errors.New("No available ports")
 
+type portRange struct {
+	start uint16
+	end   uint16
+}
+
 type PortPool struct {
 	portStart uint16
 	portEnd   uint16
 
-	current uint16
-	mu      sync.Mutex
+	// next holds offset of next port to try for each range
+	next map[portRange]uint16
+	mu   sync.Mutex
 
 	usedPorts map[uint16]struct{}
 }
@@ -21,30 +29,64 @@ func NewPortPool(start, end uint16) *PortPool {
 	return &PortPool{
 		portStart: start,
 		portEnd:   end,
-		current:   start - 1,
+		next:      map[portRange]uint16{},
 		usedPorts: make(map[uint16]struct{}, end-start),
 	}
 }
 
-func (p *PortPool) ReserveNewPort() (uint16, error) {
+// ReserveNewPort reserves a free port from the whole pool
+func (p *PortPool) ReserveNewPort(host string) (uint16, error) {
+	return p.ReservePortInRange(host, p.portStart, p.portEnd)
+}
+
+// ReservePortInRange reserves a free port from a sub range of the pool.
+// Ports that are already bound by other software are skipped.
+func (p *PortPool) ReservePortInRange(host string, start, end uint16) (uint16, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	for i := uint16(0); i < p.portEnd-p.portStart; i++ {
-		p.current = (p.current + 1) % (p.portEnd - p.portStart)
-		port := p.portStart + p.current
+	r := portRange{start, end}
+	size := end - start
+	next := p.next[r]
 
-		_, used := p.usedPorts[port]
-		if !used {
-			p.usedPorts[port] = struct{}{}
-			return port, nil
+	for i := uint16(0); i < size; i++ {
+		offset := (next + i) % size
+		port := start + offset
+
+		if _, used := p.usedPorts[port]; used {
+			continue
+		}
+		if !portFree(host, port) {
+			continue
 		}
+
+		p.usedPorts[port] = struct{}{}
+		p.next[r] = (offset + 1) % size
+		return port, nil
 	}
 	return 0, ErrNoAvailablePorts
 }
 
+// ReservePort marks port as used without checking it, it is used for ports
+// of adopted instances
+func (p *PortPool) ReservePort(port uint16) {
+	p.mu.Lock()
+	p.usedPorts[port] = struct{}{}
+	p.mu.Unlock()
+}
+
 func (p *PortPool) ReleasePort(port uint16) {
 	p.mu.Lock()
 	delete(p.usedPorts, port)
 	p.mu.Unlock()
 }
+
+// portFree checks that nothing is listening on port by binding it
+func portFree(host string, port uint16) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
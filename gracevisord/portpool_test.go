@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestPortPoolReserve(t *testing.T) {
+	pool := NewPortPool(20000, 20003)
+
+	for _, expected := range []uint16{20000, 20001, 20002} {
+		port, err := pool.ReserveNewPort("localhost")
+		if err != nil {
+			t.Fatal("Reserve failed:", err)
+		}
+		if port != expected {
+			t.Error("Incorrect port reserved:", port, expected)
+		}
+	}
+
+	if _, err := pool.ReserveNewPort("localhost"); err != ErrNoAvailablePorts {
+		t.Error("Reserve should fail when all ports are used")
+	}
+
+	pool.ReleasePort(20001)
+	port, err := pool.ReserveNewPort("localhost")
+	if err != nil || port != 20001 {
+		t.Error("Released port should be reserved again:", port, err)
+	}
+}
+
+func TestPortPoolSkipsBoundPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	bound := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	pool := NewPortPool(bound, bound+2)
+	port, err := pool.ReserveNewPort("localhost")
+	if err != nil {
+		t.Fatal("Reserve failed:", err)
+	}
+	if port == bound {
+		t.Error("Port bound by other software should be skipped:", port)
+	}
+}
+
+func TestPortPoolRange(t *testing.T) {
+	pool := NewPortPool(20000, 21000)
+
+	for i := 0; i < 2; i++ {
+		port, err := pool.ReservePortInRange("localhost", 20500, 20502)
+		if err != nil {
+			t.Fatal("Reserve in range failed:", err)
+		}
+		if port < 20500 || port >= 20502 {
+			t.Error("Port outside of range reserved:", port)
+		}
+	}
+	if _, err := pool.ReservePortInRange("localhost", 20500, 20502); err != ErrNoAvailablePorts {
+		t.Error("Reserve should fail when all ports in range are used")
+	}
+
+	port, err := pool.ReserveNewPort("localhost")
+	if err != nil || port != 20000 {
+		t.Error(fmt.Sprintf("Reserve from whole pool failed: %d %s", port, err))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type processInfo struct {
+	ppid  int
+	pgid  int
+	state string
+}
+
+// readProcesses reads parent and process group of all running processes
+// from /proc
+func readProcesses() map[int]processInfo {
+	processes := map[int]processInfo{}
+
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return processes
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join("/proc", dir.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		// command name may contain spaces and parentheses
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 3 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pgid, _ := strconv.Atoi(fields[2])
+
+		// zombies are already dead, their parent just did not reap them
+		if fields[0] == "Z" {
+			continue
+		}
+		processes[pid] = processInfo{ppid: ppid, pgid: pgid, state: fields[0]}
+	}
+	return processes
+}
+
+// descendants returns all descendants of process
+func descendants(processes map[int]processInfo, pid int) []int {
+	children := map[int][]int{}
+	for child, info := range processes {
+		children[info.ppid] = append(children[info.ppid], child)
+	}
+
+	result := []int{}
+	queue := children[pid]
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		result = append(result, child)
+		queue = append(queue, children[child]...)
+	}
+	return result
+}
+
+// groupMembers returns all processes in process group
+func groupMembers(processes map[int]processInfo, pgid int) []int {
+	result := []int{}
+	for pid, info := range processes {
+		if info.pgid == pgid {
+			result = append(result, pid)
+		}
+	}
+	return result
+}
+
+// signalGroup sends signal to process group of process, or only to process
+// if it does not lead a group
+func signalGroup(pid int, sig syscall.Signal) error {
+	if err := syscall.Kill(-pid, sig); err != syscall.ESRCH {
+		return err
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// killTree kills process group of process and all its descendants that left
+// the group. Returns descendants that escaped the group.
+func killTree(pid int) ([]int, error) {
+	processes := readProcesses()
+
+	escaped := []int{}
+	for _, child := range descendants(processes, pid) {
+		if processes[child].pgid != pid {
+			escaped = append(escaped, child)
+		}
+	}
+
+	err := signalGroup(pid, syscall.SIGKILL)
+	for _, child := range escaped {
+		syscall.Kill(child, syscall.SIGKILL)
+	}
+	return escaped, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeTestScript(t *testing.T, script string) string {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	fn := path.Join(dir, "run.sh")
+	if err := ioutil.WriteFile(fn, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// startScript starts app with script and waits until it has n descendants
+func startScript(t *testing.T, appConfig *AppConfig, n int) (*App, *Instance, []int) {
+	app := newTestApp(t, appConfig)
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+
+	var instance *Instance
+	var children []int
+	waitFor(t, app, "instance processes started", func() bool {
+		instance = app.instances[0]
+		children = descendants(readProcesses(), instance.cmd.Process.Pid)
+		return len(children) == n && instance.status == InstanceStatusServing
+	})
+	return app, instance, children
+}
+
+func checkKilled(t *testing.T, pids []int) {
+	processes := readProcesses()
+	for _, pid := range pids {
+		if _, ok := processes[pid]; ok {
+			t.Error("Process should be killed:", pid)
+		}
+	}
+}
+
+func TestInstanceStopGroup(t *testing.T) {
+	script := writeTestScript(t, "(trap '' TERM; exec sleep 30) &\nsleep 30 &\nwait\n")
+	app, instance, children := startScript(t, &AppConfig{Command: script}, 2)
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance stopped", func() bool {
+		return instance.status == InstanceStatusStopped
+	})
+
+	checkKilled(t, children)
+	app.do(func() {
+		if len(instance.orphans) != 1 {
+			t.Error("Process ignoring stop signal should be killed as orphan:", instance.orphans)
+		}
+	})
+}
+
+func TestInstanceKillTree(t *testing.T) {
+	script := writeTestScript(t, "sleep 30 &\nsetsid sleep 31 &\nwait\n")
+	app, instance, children := startScript(t, &AppConfig{
+		Command:        script,
+		StopSignalName: "CONT",
+		StopTimeout:    1,
+	}, 2)
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "instance killed", func() bool {
+		return instance.status == InstanceStatusKilled
+	})
+
+	checkKilled(t, children)
+	app.do(func() {
+		if len(instance.orphans) != 1 {
+			t.Error("Process that escaped process group should be reported:", instance.orphans)
+		}
+		if report := instance.Report(); len(report.Orphans) != 1 {
+			t.Error("Report should contain killed orphans:", report.Orphans)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+var ErrRestartSuperseded = errors.New("Restart was superseded by another restart")
+
+// HealthCheckReportInterval limits how often failed health check attempts
+// of starting instance are reported
+const HealthCheckReportInterval = time.Second
+
+// Progress records events of the last restart of app, so clients can wait
+// for its outcome. It is owned by the app supervisor.
+type Progress struct {
+	id   uint32
+	hold bool
+
+	// old are instances that were active when restart started, status
+	// changes of old and new instances are recorded
+	old     map[*Instance]bool
+	tracked map[*Instance]bool
+
+	events []*report.ProgressEvent
+	done   bool
+	err    string
+}
+
+// startProgress starts recording new restart, restart in progress is
+// superseded
+func (a *App) startProgress(hold bool) uint32 {
+	if a.progress != nil && !a.progress.done {
+		a.finishProgress(ErrRestartSuperseded.Error())
+	}
+
+	a.progressId++
+	a.progress = &Progress{
+		id:      a.progressId,
+		hold:    hold,
+		old:     map[*Instance]bool{},
+		tracked: map[*Instance]bool{},
+	}
+	for _, instance := range a.activeInstances {
+		a.progress.old[instance] = true
+		a.progress.tracked[instance] = true
+	}
+	return a.progressId
+}
+
+// progressf records event of restart in progress
+func (a *App) progressf(format string, args ...interface{}) {
+	if a.progress == nil || a.progress.done {
+		return
+	}
+	a.progress.events = append(a.progress.events, &report.ProgressEvent{
+		Time:    time.Now().UnixNano(),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// trackInstance records new instance started during restart
+func (a *App) trackInstance(instance *Instance) {
+	if a.progress == nil || a.progress.done {
+		return
+	}
+	a.progress.tracked[instance] = true
+	a.progressf("Instance %d spawned on port %d", instance.id, instance.internalPort)
+}
+
+// instanceProgress records status change of tracked instance
+func (a *App) instanceProgress(instance *Instance, status int) {
+	if a.progress == nil || !a.progress.tracked[instance] {
+		return
+	}
+
+	switch status {
+	case InstanceStatusServing:
+		a.progressf("Instance %d passed health check", instance.id)
+	case InstanceStatusStopping:
+		a.progressf("Instance %d is draining", instance.id)
+	case InstanceStatusStopped, InstanceStatusKilled:
+		a.progressf("Instance %d stopped", instance.id)
+	case InstanceStatusFailed:
+		a.progressf("Instance %d failed to start", instance.id)
+	case InstanceStatusTimedOut:
+		a.progressf("Instance %d timed out on start", instance.id)
+	case InstanceStatusExited:
+		a.progressf("Instance %d exited", instance.id)
+	}
+}
+
+func (a *App) finishProgress(err string) {
+	if err != "" {
+		a.progressf("Restart failed: %s", err)
+	} else {
+		a.progressf("Restart finished")
+	}
+	a.progress.done = true
+	a.progress.err = err
+}
+
+// checkProgress finishes restart in progress when new instances are active
+// and old ones stopped, or when restart cannot continue. Called by
+// supervisor after every event and action.
+func (a *App) checkProgress() {
+	p := a.progress
+	if p == nil || p.done {
+		return
+	}
+	if a.fatal {
+		a.finishProgress(fmt.Sprintf("Gave up after %d retries", a.restartCount))
+		return
+	}
+
+	if p.hold {
+		if len(a.held) == 0 {
+			a.finishProgress("Held instances are not running")
+			return
+		}
+		for _, instance := range a.held {
+			if instance.status != InstanceStatusServing {
+				return
+			}
+		}
+		a.finishProgress("")
+		return
+	}
+
+	if a.rollout != nil || a.shadow != nil || a.restartTimer != nil {
+		return
+	}
+	for instance := range p.tracked {
+		if instance.status == InstanceStatusStarting || instance.status == InstanceStatusStopping {
+			return
+		}
+	}
+	if len(a.replacing) > 0 {
+		// failed instance is not restarted because of restart policy
+		a.finishProgress(fmt.Sprintf("New instance failed and was not restarted (restart: %s)", a.config.Restart))
+		return
+	}
+	for instance := range p.old {
+		if instance.active {
+			a.finishProgress("Old instances are still serving")
+			return
+		}
+	}
+	if len(a.activeInstances) == 0 {
+		a.finishProgress("No instances are serving")
+		return
+	}
+	a.finishProgress("")
+}
+
+// Progress returns events of restart starting with from and its outcome
+func (a *App) Progress(id uint32, from int) *report.RestartProgress {
+	progress := &report.RestartProgress{Id: id}
+	a.do(func() {
+		p := a.progress
+		if p == nil || p.id != id {
+			progress.Done = true
+			progress.Error = ErrRestartSuperseded.Error()
+			return
+		}
+		if from < len(p.events) {
+			progress.Events = append([]*report.ProgressEvent{}, p.events[from:]...)
+		}
+		progress.Done = p.done
+		progress.Error = p.err
+	})
+	return progress
+}
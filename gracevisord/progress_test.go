@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+func progressMessages(events []*report.ProgressEvent) string {
+	messages := []string{}
+	for _, event := range events {
+		messages = append(messages, event.Message)
+	}
+	return strings.Join(messages, "\n")
+}
+
+func TestRestartProgress(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:     "sleep 30",
+		HealthCheck: &HealthCheckConfig{Path: "/"},
+	})
+	ok := func() int { return http.StatusOK }
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	newTestServer(t, app.instances[0], ok)
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	id, err := app.StartRestart(false)
+	if err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "failed health check", func() bool {
+		return strings.Contains(progressMessages(app.progress.events), "health check attempt 1 failed")
+	})
+	var instance *Instance
+	app.do(func() {
+		instance = app.instances[1]
+	})
+	newTestServer(t, instance, ok)
+
+	waitFor(t, app, "restart finished", func() bool {
+		return app.progress.done
+	})
+	progress := app.Progress(id, 0)
+	if progress.Error != "" {
+		t.Error("Restart should succeed:", progress.Error)
+	}
+
+	messages := progressMessages(progress.Events)
+	for _, message := range []string{
+		"Instance 2 spawned on port",
+		"Instance 2 passed health check",
+		"Switched traffic to instance 2",
+		"Instance 1 is draining",
+		"Instance 1 stopped",
+		"Restart finished",
+	} {
+		if !strings.Contains(messages, message) {
+			t.Errorf("Progress should contain %q: %s", message, messages)
+		}
+	}
+
+	if rest := app.Progress(id, len(progress.Events)); len(rest.Events) != 0 {
+		t.Error("Progress should return events starting with from:", rest.Events)
+	}
+	if old := app.Progress(id-1, 0); !old.Done || old.Error != ErrRestartSuperseded.Error() {
+		t.Error("Previous restart should be superseded:", old)
+	}
+}
+
+func TestRestartProgressFailed(t *testing.T) {
+	script := writeTestScript(t, "test -f $1 && exit 1\necho ready\nexec sleep 30\n")
+	marker := path.Join(path.Dir(script), "fail")
+	app := newTestApp(t, &AppConfig{
+		Command:      script + " " + marker,
+		ReadyPattern: "ready",
+		MaxRetries:   1,
+		Backoff:      &BackoffConfig{Multiplier: 1},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	id, err := app.StartRestart(false)
+	if err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+
+	waitFor(t, app, "restart failed", func() bool {
+		return app.progress.done
+	})
+	progress := app.Progress(id, 0)
+	if !strings.Contains(progress.Error, "Gave up") {
+		t.Error("Restart should fail:", progressMessages(progress.Events))
+	}
+	if !strings.Contains(progressMessages(progress.Events), "Instance 2 failed to start") {
+		t.Error("Progress should contain failed instance:", progressMessages(progress.Events))
+	}
+}
+
+func TestRestartProgressNotRestarted(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:      "sleep 30",
+		HealthCheck:  &HealthCheckConfig{Path: "/"},
+		StartTimeout: 1,
+		Restart:      RestartNever,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	newTestServer(t, app.instances[0], func() int { return http.StatusOK })
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	id, err := app.StartRestart(false)
+	if err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "restart failed", func() bool {
+		return app.progress.done
+	})
+	progress := app.Progress(id, 0)
+	if !strings.Contains(progress.Error, "not restarted") {
+		t.Error("Restart should fail when new instance is not restarted:", progress.Error)
+	}
+	if !strings.Contains(progressMessages(progress.Events), "Instance 2 timed out on start") {
+		t.Error("Progress should contain timed out instance:", progressMessages(progress.Events))
+	}
+	app.do(func() {
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 1 {
+			t.Error("Old instance should keep serving")
+		}
+	})
+}
@@ -7,11 +7,14 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -80,12 +83,10 @@ func (c *runOnFirstRead) Read(bs []byte) (int, error) {
 }
 
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	outreq := new(http.Request)
-	*outreq = *req
-
-	instance, err := p.App.reserveInstance()
+	debug := p.App.debugRoutingConfig()
+	instance, err := p.App.reserveRequestInstance(req, debug)
 	if err != nil {
-		if err == ErrNoActiveInstances {
+		if err == ErrNoActiveInstances || err == ErrInstanceNotRunning {
 			rw.WriteHeader(http.StatusServiceUnavailable)
 		} else {
 			rw.WriteHeader(http.StatusInternalServerError)
@@ -95,6 +96,26 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	defer instance.Done()
 
+	if debug != nil {
+		rw.Header().Set(debug.ResponseHeader, strconv.FormatUint(uint64(instance.id), 10))
+	}
+
+	// request is canceled when drain timeout of instance expires
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	untrack := instance.Track(cancel)
+	defer untrack()
+
+	outreq := req.WithContext(ctx)
+
+	// copy of sampled request is replayed to shadowed instance
+	shadow := p.App.shadowTarget()
+	shadowing := shadow != nil && shadow.instance != instance && shadow.accepts(outreq)
+	var shadowBody []byte
+	if shadowing {
+		shadowBody, shadowing = shadow.bufferBody(outreq)
+	}
+
 	transport := http.DefaultTransport.(*http.Transport)
 
 	if closeNotifier, ok := rw.(http.CloseNotifier); ok {
@@ -113,6 +134,7 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 					go func() {
 						select {
 						case <-clientGone:
+							cancel()
 							transport.CancelRequest(outreq)
 						case <-reqDone:
 						}
@@ -144,12 +166,25 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	start := time.Now()
 	res, err := transport.RoundTrip(outreq)
 	if err != nil {
 		log.Printf("http: proxy error: %v", err)
+		// requests canceled by client or drain timeout are not failures
+		// of instance
+		if ctx.Err() == nil {
+			instance.RecordRequest(true)
+			instance.ProxyError()
+		}
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	instance.RecordRequest(res.StatusCode >= 500)
+	instance.ProxySuccess()
+
+	if shadowing {
+		shadow.replay(outreq, shadowBody, res.StatusCode, time.Since(start))
+	}
 
 	for _, h := range hopHeaders {
 		res.Header.Del(h)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReverseProxyPassiveHealth(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:        "sleep 30",
+		MaxProxyErrors: 3,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	// nothing listens on instance port so every request fails
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		rw := httptest.NewRecorder()
+		app.rp.ServeHTTP(rw, req)
+		if rw.Code != http.StatusInternalServerError {
+			t.Error("Failed proxy request should return 500:", rw.Code)
+		}
+	}
+
+	waitFor(t, app, "unhealthy instance replaced", func() bool {
+		return app.instances[0].unhealthy && len(app.activeInstances) == 1 && app.activeInstances[0].id == 2
+	})
+	app.do(func() {
+		report := app.instances[0].Report()
+		if report.ProxyErrors != 3 || report.ConsecutiveProxyErrors != 3 {
+			t.Error("Proxy errors should be reported:", report.ProxyErrors, report.ConsecutiveProxyErrors)
+		}
+	})
+}
+
+func TestReverseProxyCanceledRequest(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:        "sleep 30",
+		MaxProxyErrors: 2,
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		app.rp.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	}
+
+	app.do(func() {
+		report := app.instances[0].Report()
+		if report.ProxyErrors != 0 || app.instances[0].unhealthy {
+			t.Error("Canceled requests should not count as proxy errors:", report.ProxyErrors)
+		}
+		if counters := app.instances[0].RequestCounters(); counters.errors != 0 {
+			t.Error("Canceled requests should not count into error rate:", counters.errors)
+		}
+	})
+}
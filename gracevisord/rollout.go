@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+var ErrNoRollout = errors.New("No rollout in progress")
+
+// Rollout shifts traffic from active instances to a new set of instances in
+// configured steps
+type Rollout struct {
+	instances []*Instance
+	step      int
+	weight    int
+	timer     *time.Timer
+}
+
+// startRollout starts a new set of canary instances. Traffic is shifted once
+// all of them are serving.
+func (a *App) startRollout() error {
+	if a.rollout != nil {
+		a.abortRollout()
+	}
+
+	a.rollout = &Rollout{step: -1}
+	for i := 0; i < a.config.Replicas; i++ {
+		instance, err := a.startNewInstance(nil)
+		if err != nil {
+			a.abortRollout()
+			return err
+		}
+		instance.canary = true
+		a.rollout.instances = append(a.rollout.instances, instance)
+	}
+
+	return nil
+}
+
+func (a *App) canaryServing(instance *Instance) {
+	if a.rollout.step >= 0 {
+		return
+	}
+	for _, canary := range a.rollout.instances {
+		if canary.status != InstanceStatusServing {
+			return
+		}
+	}
+	a.rolloutStep(0)
+}
+
+func (a *App) canaryFailed(instance *Instance) {
+	log.Printf("%s: Rollout aborted, instance %d %s", a.config.Name, instance.id, instance.StatusString())
+	a.progressf("Rollout aborted, instance %d %s", instance.id, instance.StatusString())
+	a.abortRollout()
+}
+
+func (a *App) rolloutStep(step int) {
+	rollout := a.rollout
+	if step >= len(a.config.Rollout.Steps) {
+		a.promoteRollout()
+		return
+	}
+
+	stepConfig := a.config.Rollout.Steps[step]
+	rollout.step = step
+	rollout.weight = stepConfig.Weight
+	a.setCanaryInstances(rollout.instances, rollout.weight)
+	log.Printf("%s: Rollout step %d/%d, %d%% of traffic to new instances", a.config.Name, step+1, len(a.config.Rollout.Steps), rollout.weight)
+	a.progressf("Rollout step %d/%d, %d%% of traffic to new instances", step+1, len(a.config.Rollout.Steps), rollout.weight)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(stepConfig.Duration)*time.Second, func() {
+		a.post(func() {
+			if a.rollout == rollout && rollout.timer == timer {
+				a.rolloutStep(step + 1)
+			}
+		})
+	})
+	rollout.timer = timer
+}
+
+// promoteRollout moves all traffic to new instances and stops the old ones
+func (a *App) promoteRollout() {
+	rollout := a.rollout
+	a.rollout = nil
+	if rollout.timer != nil {
+		rollout.timer.Stop()
+	}
+
+	old := a.activeInstances
+	for _, instance := range rollout.instances {
+		instance.canary = false
+		instance.setActive(true)
+	}
+	a.setCanaryInstances(nil, 0)
+	a.setActiveInstances(rollout.instances)
+
+	for _, instance := range old {
+		instance.setActive(false)
+	}
+	a.retire(old, rollout.instances)
+	log.Printf("%s: Rollout promoted", a.config.Name)
+	a.progressf("Rollout promoted, switched traffic to new instances")
+}
+
+// abortRollout moves all traffic back to active instances and stops new ones
+func (a *App) abortRollout() {
+	rollout := a.rollout
+	a.rollout = nil
+	if rollout.timer != nil {
+		rollout.timer.Stop()
+	}
+
+	a.setCanaryInstances(nil, 0)
+	for _, instance := range rollout.instances {
+		instance.canary = false
+		if instance.status == InstanceStatusServing || instance.status == InstanceStatusStarting {
+			instance.Stop()
+		}
+	}
+}
+
+// Promote finishes rollout in progress or moves traffic to held instances
+func (a *App) Promote() error {
+	var err error
+	a.do(func() {
+		if a.rollout == nil && len(a.held) > 0 {
+			for _, instance := range a.held {
+				if instance.status != InstanceStatusServing {
+					err = ErrInstanceNotRunning
+					return
+				}
+			}
+			a.promoteHeld()
+			return
+		}
+		if a.rollout == nil {
+			err = ErrNoRollout
+			return
+		}
+		for _, instance := range a.rollout.instances {
+			if instance.status != InstanceStatusServing {
+				err = ErrInstanceNotRunning
+				return
+			}
+		}
+		a.promoteRollout()
+	})
+	return err
+}
+
+// Abort cancels rollout in progress
+func (a *App) Abort() error {
+	var err error
+	a.do(func() {
+		if a.rollout == nil {
+			err = ErrNoRollout
+			return
+		}
+		log.Printf("%s: Rollout aborted", a.config.Name)
+		a.abortRollout()
+	})
+	return err
+}
+
+func (r *Rollout) Report(steps int) *report.Rollout {
+	return &report.Rollout{
+		Step:   r.step + 1,
+		Steps:  steps,
+		Weight: r.weight,
+	}
+}
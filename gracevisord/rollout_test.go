@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestAppRollout(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Rollout: &RolloutConfig{
+			Steps: []*RolloutStepConfig{
+				&RolloutStepConfig{Weight: 50, Duration: 30},
+				&RolloutStepConfig{Weight: 100, Duration: 30},
+			},
+		},
+	})
+
+	if app.Promote() != ErrNoRollout {
+		t.Error("Promote should fail without rollout")
+	}
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "first rollout step", func() bool {
+		return len(app.canaryInstances) == 1 && app.canaryWeight == 50
+	})
+
+	picked := map[uint32]int{}
+	for i := 0; i < 1000; i++ {
+		instance, err := app.reserveInstance()
+		if err != nil {
+			t.Fatal("No instance reserved:", err)
+		}
+		picked[instance.id]++
+		instance.Done()
+	}
+	if picked[1] < 350 || picked[2] < 350 {
+		t.Error("Traffic should be split between old and new instance:", picked)
+	}
+
+	if err := app.Promote(); err != nil {
+		t.Fatal("Promote failed:", err)
+	}
+	app.do(func() {
+		if app.rollout != nil || len(app.canaryInstances) != 0 {
+			t.Error("Promote should finish rollout")
+		}
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 2 {
+			t.Error("Promote should move traffic to new instance")
+		}
+		if app.instances[0].status == InstanceStatusServing {
+			t.Error("Promote should stop old instance")
+		}
+	})
+}
+
+func TestAppRolloutAbort(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Rollout: &RolloutConfig{
+			Steps: []*RolloutStepConfig{
+				&RolloutStepConfig{Weight: 5, Duration: 30},
+			},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "first rollout step", func() bool {
+		return app.canaryWeight == 5
+	})
+
+	if err := app.Abort(); err != nil {
+		t.Fatal("Abort failed:", err)
+	}
+	app.do(func() {
+		if app.rollout != nil || len(app.canaryInstances) != 0 {
+			t.Error("Abort should cancel rollout")
+		}
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 1 {
+			t.Error("Abort should keep traffic on old instance")
+		}
+		if app.instances[1].status == InstanceStatusServing {
+			t.Error("Abort should stop new instance")
+		}
+	})
+}
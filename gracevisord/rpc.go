@@ -3,49 +3,94 @@ package main
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/rpc"
-	"sort"
+	"os"
+	"os/exec"
+	"time"
 
 	"github.com/hamaxx/gracevisor/common/report"
 )
 
 var ErrInvalidApp = errors.New("Invalid app")
 
-type AppNameSort []*App
+type Rpc struct {
+	daemon *Daemon
+}
 
-func (v AppNameSort) Len() int {
-	return len(v)
+// Restart replies with id of restart progress
+func (r *Rpc) Restart(args report.RestartArgs, id *uint32) error {
+	app, ok := r.daemon.App(args.Name)
+	if !ok {
+		return ErrInvalidApp
+	}
+	var err error
+	*id, err = app.StartRestart(args.Hold)
+	return err
 }
-func (v AppNameSort) Swap(i, j int) {
-	v[i], v[j] = v[j], v[i]
+
+func (r *Rpc) RestartProgress(args report.ProgressArgs, res *report.RestartProgress) error {
+	app, ok := r.daemon.App(args.Name)
+	if !ok {
+		return ErrInvalidApp
+	}
+	*res = *app.Progress(args.Id, args.From)
+	return nil
+}
+
+// MatchApps replies with names of apps selected for bulk commands
+func (r *Rpc) MatchApps(args report.MatchArgs, res *[]string) error {
+	names, err := r.daemon.MatchApps(args.Patterns, args.Groups, args.All)
+	if err != nil {
+		return err
+	}
+	*res = names
+	return nil
 }
-func (v AppNameSort) Less(i, j int) bool {
-	return v[i].config.Name < v[j].config.Name
+
+func (r *Rpc) Start(appName string, res *string) error {
+	app, ok := r.daemon.App(appName)
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.Restart()
 }
 
-type Rpc struct {
-	runningApps map[string]*App
+func (r *Rpc) Reset(appName string, res *string) error {
+	app, ok := r.daemon.App(appName)
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.Reset()
 }
 
-func (r *Rpc) Restart(appName string, res *string) error {
-	app, ok := r.runningApps[appName]
+func (r *Rpc) Promote(appName string, res *string) error {
+	app, ok := r.daemon.App(appName)
 	if !ok {
 		return ErrInvalidApp
 	}
-	return app.StartNewInstance()
+	return app.Promote()
 }
 
-func (r *Rpc) Start(appName string, res *string) error {
-	app, ok := r.runningApps[appName]
+func (r *Rpc) Abort(appName string, res *string) error {
+	app, ok := r.daemon.App(appName)
 	if !ok {
 		return ErrInvalidApp
 	}
-	return app.StartNewInstance()
+	return app.Abort()
+}
+
+func (r *Rpc) Discard(appName string, res *string) error {
+	app, ok := r.daemon.App(appName)
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.Discard()
 }
 
 func (r *Rpc) Stop(appName string, res *string) error {
-	app, ok := r.runningApps[appName]
+	app, ok := r.daemon.App(appName)
 	if !ok {
 		return ErrInvalidApp
 	}
@@ -53,7 +98,7 @@ func (r *Rpc) Stop(appName string, res *string) error {
 }
 
 func (r *Rpc) Kill(appName string, res *string) error {
-	app, ok := r.runningApps[appName]
+	app, ok := r.daemon.App(appName)
 	if !ok {
 		return ErrInvalidApp
 	}
@@ -62,28 +107,65 @@ func (r *Rpc) Kill(appName string, res *string) error {
 
 func (r *Rpc) Status(appName string, res *[]*report.App) error {
 	if appName != "" {
-		app, ok := r.runningApps[appName]
+		app, ok := r.daemon.App(appName)
 		if !ok {
 			return ErrInvalidApp
 		}
 		*res = append(*res, app.Report(10))
 	} else {
-		sortedApps := []*App{}
-		for _, app := range r.runningApps {
-			sortedApps = append(sortedApps, app)
-		}
-		sort.Sort(AppNameSort(sortedApps))
-		for _, app := range sortedApps {
+		for _, app := range r.daemon.Apps() {
 			*res = append(*res, app.Report(3))
 		}
 	}
 	return nil
 }
 
-func NewRpcServer(runningApps map[string]*App, config *RpcConfig) (net.Listener, error) {
+func (r *Rpc) History(appName string, res *[]*report.InstanceRecord) error {
+	app, ok := r.daemon.App(appName)
+	if !ok {
+		return ErrInvalidApp
+	}
+	*res = app.History()
+	return nil
+}
+
+func (r *Rpc) Reload(args string, res *string) error {
+	return r.daemon.Reload()
+}
+
+func (r *Rpc) AddApp(args report.AppArgs, res *string) error {
+	return r.daemon.AddApp(args.Config, args.Persist)
+}
+
+func (r *Rpc) UpdateApp(args report.AppArgs, res *string) error {
+	return r.daemon.UpdateApp(args.Config, args.Persist)
+}
+
+func (r *Rpc) RemoveApp(args report.AppArgs, res *string) error {
+	return r.daemon.RemoveApp(args.Name, args.Persist)
+}
+
+func (r *Rpc) Upgrade(args string, res *string) error {
+	if _, err := exec.LookPath(os.Args[0]); err != nil {
+		return err
+	}
+	if _, err := ParseConfing(r.daemon.configPath); err != nil {
+		return err
+	}
+
+	// give rpc reply time to be sent before daemon is re-executed
+	time.AfterFunc(UpgradeReplyDelay, func() {
+		if err := r.daemon.Upgrade(); err != nil {
+			log.Print("Upgrade failed: ", err)
+		}
+	})
+	return nil
+}
+
+func NewRpcServer(daemon *Daemon, config *RpcConfig) (net.Listener, error) {
 
 	r := &Rpc{
-		runningApps: runningApps,
+		daemon: daemon,
 	}
 
 	if err := rpc.Register(r); err != nil {
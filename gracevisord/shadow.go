@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// ShadowMaxRequests limits shadow requests in flight, requests over the
+// limit are dropped
+const ShadowMaxRequests = 100
+
+// Shadow replays copies of live requests to new instance during shadow
+// phase and compares responses with the ones of active instances
+type Shadow struct {
+	instance *Instance
+	config   *ShadowConfig
+	start    time.Time
+	timer    *time.Timer
+	client   *http.Client
+	inflight chan struct{}
+
+	requests   int64
+	mismatches int64
+	errors     int64
+	dropped    int64
+
+	// latency sums of compared requests in nanoseconds
+	activeLatency int64
+	shadowLatency int64
+}
+
+func NewShadow(instance *Instance, config *ShadowConfig) *Shadow {
+	return &Shadow{
+		instance: instance,
+		config:   config,
+		start:    time.Now(),
+		client: &http.Client{
+			Timeout: time.Duration(config.Timeout) * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inflight: make(chan struct{}, ShadowMaxRequests),
+	}
+}
+
+// accepts samples requests with allowed methods
+func (s *Shadow) accepts(req *http.Request) bool {
+	for _, method := range s.config.Methods {
+		if req.Method == method {
+			return rand.Intn(100) < s.config.Percent
+		}
+	}
+	return false
+}
+
+// bufferBody reads request body so it can be replayed, returns false if
+// body is larger than limit
+func (s *Shadow) bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	rest := req.Body
+	body, err := ioutil.ReadAll(io.LimitReader(rest, s.config.MaxBody+1))
+	if err != nil || int64(len(body)) > s.config.MaxBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rest), rest}
+		return nil, false
+	}
+
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), rest}
+	return body, true
+}
+
+// replay sends copy of request to shadowed instance in background and
+// compares response with status and latency of active instance
+func (s *Shadow) replay(req *http.Request, body []byte, status int, latency time.Duration) {
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+
+	shadowReq, err := http.NewRequest(req.Method, "http://"+s.instance.internalHostPort+req.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		<-s.inflight
+		return
+	}
+	shadowReq.Header = req.Header.Clone()
+	shadowReq.Host = req.Host
+
+	s.instance.Serve()
+	go func() {
+		defer func() {
+			s.instance.Done()
+			<-s.inflight
+		}()
+
+		atomic.AddInt64(&s.requests, 1)
+		start := time.Now()
+		res, err := s.client.Do(shadowReq)
+		if err != nil {
+			atomic.AddInt64(&s.errors, 1)
+			return
+		}
+		// latency of both instances is time to response headers
+		shadowLatency := time.Since(start)
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+
+		atomic.AddInt64(&s.activeLatency, int64(latency))
+		atomic.AddInt64(&s.shadowLatency, int64(shadowLatency))
+		if res.StatusCode != status {
+			atomic.AddInt64(&s.mismatches, 1)
+		}
+	}()
+}
+
+func (s *Shadow) Report(running bool) *report.Shadow {
+	shadowReport := &report.Shadow{
+		Instance:   s.instance.id,
+		Running:    running,
+		Requests:   atomic.LoadInt64(&s.requests),
+		Mismatches: atomic.LoadInt64(&s.mismatches),
+		Errors:     atomic.LoadInt64(&s.errors),
+		Dropped:    atomic.LoadInt64(&s.dropped),
+	}
+	if running {
+		duration := time.Duration(s.config.Duration) * time.Second
+		shadowReport.Left = uint64((duration - time.Since(s.start)) / time.Second)
+	}
+	if compared := shadowReport.Requests - shadowReport.Errors; compared > 0 {
+		shadowReport.ActiveLatency = float64(atomic.LoadInt64(&s.activeLatency)) / float64(compared) / float64(time.Millisecond)
+		shadowReport.ShadowLatency = float64(atomic.LoadInt64(&s.shadowLatency)) / float64(compared) / float64(time.Millisecond)
+	}
+	return shadowReport
+}
+
+// startShadow starts shadow phase for new instance replacing an active one,
+// traffic is switched when the phase ends. Returns false if there is
+// nothing to shadow.
+func (a *App) startShadow(instance *Instance) bool {
+	old := instance.replaces
+	if a.config.Shadow == nil || a.shadow != nil || old == nil || !old.active || old.unhealthy {
+		return false
+	}
+
+	shadow := NewShadow(instance, a.config.Shadow)
+	instance.shadowing = true
+	a.setShadow(shadow)
+	log.Printf("%s: Shadowing %d%% of requests to instance %d", a.config.Name, shadow.config.Percent, instance.id)
+	a.progressf("Shadowing %d%% of requests to instance %d for %ds", shadow.config.Percent, instance.id, shadow.config.Duration)
+
+	shadow.timer = time.AfterFunc(time.Duration(shadow.config.Duration)*time.Second, func() {
+		a.post(func() {
+			if a.shadow != shadow {
+				return
+			}
+			a.endShadow()
+			a.shadowDone(instance)
+		})
+	})
+	return true
+}
+
+// shadowDone switches traffic to instance after shadow phase, restart is
+// aborted if instance became unhealthy
+func (a *App) shadowDone(instance *Instance) {
+	if instance.status != InstanceStatusServing {
+		return
+	}
+	if instance.unhealthy {
+		log.Printf("%s: Instance %d became unhealthy while shadowing, restart aborted", a.config.Name, instance.id)
+		a.progressf("Instance %d became unhealthy while shadowing", instance.id)
+		a.replacing = nil
+		instance.Stop()
+		return
+	}
+	a.switchTraffic(instance)
+}
+
+func (a *App) endShadow() {
+	shadow := a.shadow
+	shadow.timer.Stop()
+	shadow.instance.shadowing = false
+	a.lastShadow = shadow.Report(false)
+	a.setShadow(nil)
+}
+
+// abortShadow ends shadow phase and stops shadowed instance
+func (a *App) abortShadow() {
+	instance := a.shadow.instance
+	a.endShadow()
+	if instance.status == InstanceStatusServing {
+		instance.Stop()
+	}
+}
+
+func (a *App) setShadow(shadow *Shadow) {
+	a.activeInstanceLock.Lock()
+	a.shadow = shadow
+	a.activeInstanceLock.Unlock()
+}
+
+// shadowTarget returns shadow in progress, called by proxies
+func (a *App) shadowTarget() *Shadow {
+	a.activeInstanceLock.RLock()
+	defer a.activeInstanceLock.RUnlock()
+	return a.shadow
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppShadow(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:     "sleep 30",
+		HealthCheck: &HealthCheckConfig{Path: "/health"},
+		Shadow:      &ShadowConfig{Percent: 100, Duration: 1, MaxBody: 10},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	var instance *Instance
+	app.do(func() {
+		instance = app.instances[0]
+	})
+	newTestServer(t, instance, func() int { return http.StatusOK })
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	app.do(func() {
+		instance = app.instances[1]
+	})
+	var shadowed, shadowedBody int64
+	newTestHandlerServer(t, instance, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		atomic.AddInt64(&shadowed, 1)
+		if r.URL.RawQuery == "body" {
+			atomic.AddInt64(&shadowedBody, 1)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	waitFor(t, app, "new instance shadowing", func() bool {
+		return instance.Report().Status == "shadowing" && len(app.activeInstances) == 1 && app.activeInstances[0].id == 1
+	})
+
+	for _, body := range []string{"", "", "small", "too large body"} {
+		req, _ := http.NewRequest("GET", "http://localhost/?body", strings.NewReader(body))
+		if body == "" {
+			req, _ = http.NewRequest("GET", "http://localhost/", nil)
+		}
+		rw := httptest.NewRecorder()
+		app.rp.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Error("Request should be served by active instance:", rw.Code)
+		}
+	}
+	req, _ := http.NewRequest("POST", "http://localhost/", nil)
+	app.rp.ServeHTTP(httptest.NewRecorder(), req)
+
+	waitFor(t, app, "shadow requests compared", func() bool {
+		report := app.report(10).Shadow
+		return report != nil && report.Running && report.Requests == 3 && report.Mismatches == 3
+	})
+	if atomic.LoadInt64(&shadowed) != 3 || atomic.LoadInt64(&shadowedBody) != 1 {
+		t.Error("Only sampled requests with small body should be shadowed:", shadowed, shadowedBody)
+	}
+
+	waitFor(t, app, "traffic switched after shadow phase", func() bool {
+		return len(app.activeInstances) == 1 && app.activeInstances[0].id == 2
+	})
+	app.do(func() {
+		report := app.report(10).Shadow
+		if report == nil || report.Running || report.Instance != 2 || report.Requests != 3 {
+			t.Error("Shadow summary should be kept after switch:", report)
+		}
+		if app.instances[1].Report().Status != "serving" {
+			t.Error("Instance should be serving after shadow phase")
+		}
+	})
+}
+
+func TestShadowLatency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("slow body"))
+	}))
+	defer server.Close()
+
+	instance := &Instance{id: 2, internalHostPort: strings.TrimPrefix(server.URL, "http://")}
+	shadow := NewShadow(instance, &ShadowConfig{Timeout: 5})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	shadow.replay(req, nil, http.StatusOK, 10*time.Millisecond)
+
+	// wait for replay to finish
+	shadow.inflight <- struct{}{}
+	for len(shadow.inflight) > 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	report := shadow.Report(false)
+	if report.Requests != 1 || report.Mismatches != 0 {
+		t.Fatal("Request should be replayed:", report.Requests, report.Mismatches)
+	}
+	// latency is measured to response headers like for active instance
+	if report.ShadowLatency >= 200 {
+		t.Error("Shadow latency should not include body transfer:", report.ShadowLatency)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"sync"
@@ -44,43 +45,51 @@ func (p *TcpProxy) processConn(lconn *net.TCPConn) {
 		log.Print(err)
 		return
 	}
+	defer instance.Done()
 
 	raddr, err := net.ResolveTCPAddr("tcp", instance.internalHostPort)
 	if err != nil {
 		log.Printf("Remote connection failed: %s", err)
+		instance.RecordRequest(true)
+		instance.ProxyError()
 		return
 	}
 	rconn, err := net.DialTCP("tcp", nil, raddr)
 	if err != nil {
 		log.Printf("Remote connection failed: %s", err)
+		instance.RecordRequest(true)
+		instance.ProxyError()
 		return
 	}
+	instance.RecordRequest(false)
+	instance.ProxySuccess()
+
+	untrack := instance.Track(func() {
+		lconn.Close()
+		rconn.Close()
+	})
+	defer untrack()
 
 	p.connHandler(lconn, rconn)
-	instance.Done()
 
 	rconn.Close()
 }
 
-func (p *TcpProxy) ServeTcp() error {
-	laddr, err := net.ResolveTCPAddr("tcp", p.App.externalHostPort)
-	if err != nil {
-		return err
-	}
-	listener, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		return err
-	}
-
+// Serve accepts connections on listener until it is closed
+func (p *TcpProxy) Serve(listener net.Listener) error {
 	for {
 		p.throttle <- struct{}{}
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 
 		if err != nil {
+			<-p.throttle
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Printf("Failed to accept connection '%s'\n", err)
 			continue
 		}
-		go p.processConn(conn)
+		go p.processConn(conn.(*net.TCPConn))
 	}
 }
 
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var ErrUpgradeInProgress = errors.New("Upgrade is already in progress")
+
+const (
+	// UpgradeStateEnv holds file descriptor of state passed to re-executed
+	// daemon
+	UpgradeStateEnv = "GRACEVISOR_STATE_FD"
+
+	// UpgradeDrainTimeout is how long daemon waits for proxied connections
+	// to finish before re-executing itself
+	UpgradeDrainTimeout = 10 * time.Second
+
+	// UpgradeReplyDelay postpones upgrade requested over rpc until reply is
+	// sent
+	UpgradeReplyDelay = 100 * time.Millisecond
+)
+
+// DaemonState is passed to re-executed daemon so it can adopt running
+// instances and listeners. File descriptors are inherited on exec.
+type DaemonState struct {
+	Apps []*AppState
+}
+
+type AppState struct {
+	Name       string
+	ListenerFd int
+	InstanceId uint32
+	Instances  []*InstanceState
+	Replacing  []uint32
+
+	// Config is raw config of app added or updated at runtime, app is
+	// adopted with it instead of config from config files
+	Config []byte
+
+	// instances are kept to wait for their connections to finish and thaw
+	// resumes app supervisor if upgrade fails
+	instances []*Instance
+	thaw      chan struct{}
+}
+
+type InstanceState struct {
+	Id           uint32
+	Pid          int
+	Port         uint16
+	Status       int
+	Active       bool
+	Ready        bool
+	Replaces     uint32
+	StopStep     int
+	Started      time.Time
+	LastChange   time.Time
+	ServingSince time.Time
+
+	StdoutFd   int
+	StderrFd   int
+	NotifyFd   int
+	NotifyPath string
+}
+
+// inheritFd duplicates file descriptor of conn without close on exec flag so
+// it is inherited by re-executed daemon
+func inheritFd(conn syscall.Conn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	var dupErr error
+	if err := raw.Control(func(sysFd uintptr) {
+		fd, dupErr = syscall.Dup(int(sysFd))
+	}); err != nil {
+		return 0, err
+	}
+	return fd, dupErr
+}
+
+// fds returns all inherited file descriptors of app state
+func (s *AppState) fds() []int {
+	fds := []int{}
+	if s.ListenerFd != 0 {
+		fds = append(fds, s.ListenerFd)
+	}
+	for _, instance := range s.Instances {
+		for _, fd := range []int{instance.StdoutFd, instance.StderrFd, instance.NotifyFd} {
+			if fd != 0 {
+				fds = append(fds, fd)
+			}
+		}
+	}
+	return fds
+}
+
+func (s *AppState) closeFds() {
+	for _, fd := range s.fds() {
+		syscall.Close(fd)
+	}
+}
+
+// freeze stops app supervisor and listener and returns app state. Supervisor
+// stays blocked until state is thawed.
+func (a *App) freeze() (*AppState, error) {
+	var state *AppState
+	var err error
+	frozen := make(chan struct{})
+	thaw := make(chan struct{})
+
+	a.actions <- func() {
+		state, err = a.saveState()
+		if err != nil {
+			close(frozen)
+			return
+		}
+		state.thaw = thaw
+		close(frozen)
+
+		// only reached if upgrade failed
+		<-thaw
+		a.restoreListener(state)
+		state.closeFds()
+	}
+	<-frozen
+
+	return state, err
+}
+
+// saveState stops rollout, held instances, shadow phase and rollback watch
+// and collects state of running instances
+func (a *App) saveState() (*AppState, error) {
+	if a.rollout != nil {
+		a.abortRollout()
+	}
+	if len(a.held) > 0 {
+		a.discardHeld()
+	}
+	if a.shadow != nil {
+		a.abortShadow()
+	}
+	if a.watch != nil {
+		a.endWatch(true)
+	}
+	a.cancelRestart()
+
+	state := &AppState{
+		Name:       a.config.Name,
+		InstanceId: atomic.LoadUint32(&a.instanceId),
+		Config:     a.config.data,
+	}
+
+	var err error
+	if a.listener != nil {
+		if state.ListenerFd, err = inheritFd(a.listener.(syscall.Conn)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, instance := range a.instances {
+		if instance.terminated() {
+			continue
+		}
+		if instance.cmd == nil {
+			log.Printf("%s: Instance %d is running pre_start hook, it is not adopted", a.config.Name, instance.id)
+			continue
+		}
+		instanceState, err := instance.saveState()
+		if instanceState != nil {
+			state.Instances = append(state.Instances, instanceState)
+		}
+		if err != nil {
+			state.closeFds()
+			return nil, err
+		}
+		state.instances = append(state.instances, instance)
+	}
+
+	for _, instance := range a.replacing {
+		state.Replacing = append(state.Replacing, instance.id)
+	}
+
+	if a.listener != nil {
+		a.closeListener()
+	}
+	return state, nil
+}
+
+// restoreListener starts serving on inherited listener after failed upgrade
+func (a *App) restoreListener(state *AppState) {
+	if state.ListenerFd == 0 {
+		return
+	}
+	file := os.NewFile(uintptr(state.ListenerFd), "listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	state.ListenerFd = 0
+	if err != nil {
+		log.Print(a.config.Name, ": Cannot restore listener: ", err)
+		return
+	}
+	a.serve(listener, a.config.Name, a.config.Proxy)
+}
+
+func (i *Instance) saveState() (*InstanceState, error) {
+	state := &InstanceState{
+		Id:           i.id,
+		Pid:          i.cmd.Process.Pid,
+		Port:         i.internalPort,
+		Status:       i.status,
+		Active:       i.active,
+		StopStep:     i.stopStep,
+		Ready:        i.isReady(),
+		Started:      i.started,
+		LastChange:   i.lastChange,
+		ServingSince: i.servingSince,
+	}
+	if i.replaces != nil {
+		state.Replaces = i.replaces.id
+	}
+
+	var err error
+	if state.StdoutFd, err = inheritFd(i.stdout); err != nil {
+		return state, err
+	}
+	if state.StderrFd, err = inheritFd(i.stderr); err != nil {
+		return state, err
+	}
+	if i.notifySocket != nil {
+		state.NotifyPath = i.notifySocket.path
+		if state.NotifyFd, err = inheritFd(i.notifySocket.conn); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// Adopt takes over listener and instances of app from state passed by
+// previous daemon process
+func (a *App) Adopt(state *AppState) error {
+	var err error
+	a.do(func() {
+		err = a.adopt(state)
+	})
+	return err
+}
+
+func (a *App) adopt(state *AppState) error {
+	atomic.StoreUint32(&a.instanceId, state.InstanceId)
+
+	byId := map[uint32]*Instance{}
+	for _, instanceState := range state.Instances {
+		instance, err := AdoptInstance(a, instanceState)
+		if err != nil {
+			log.Printf("%s: Cannot adopt instance %d: %s", a.config.Name, instanceState.Id, err)
+			continue
+		}
+		byId[instance.id] = instance
+		a.instances = append(a.instances, instance)
+		if instanceState.Active {
+			a.addActive(instance)
+		}
+	}
+	for _, instanceState := range state.Instances {
+		if instance, ok := byId[instanceState.Id]; ok && instanceState.Replaces != 0 {
+			instance.replaces = byId[instanceState.Replaces]
+		}
+	}
+
+	if state.ListenerFd != 0 {
+		file := os.NewFile(uintptr(state.ListenerFd), "listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		a.externalHostPort = fmt.Sprintf("%s:%d", a.config.ExternalHost, a.config.ExternalPort)
+		a.serve(listener, a.config.Name, a.config.Proxy)
+	} else if err := a.listen(a.config); err != nil {
+		return err
+	}
+
+	for _, id := range state.Replacing {
+		if instance, ok := byId[id]; ok {
+			a.replacing = append(a.replacing, instance)
+		}
+	}
+	return a.scale()
+}
+
+// AdoptInstance takes over instance process started by previous daemon
+// process
+func AdoptInstance(app *App, state *InstanceState) (*Instance, error) {
+	process, err := os.FindProcess(state.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	app.portPool.ReservePort(state.Port)
+	instance := &Instance{
+		id:               state.Id,
+		app:              app,
+		config:           app.config,
+		internalHost:     app.config.InternalHost,
+		internalPort:     state.Port,
+		internalHostPort: fmt.Sprintf("%s:%d", app.config.InternalHost, state.Port),
+		status:           InstanceStatusStarting,
+		active:           state.Active,
+		closers:          map[uint64]func(){},
+		started:          state.Started,
+		servingSince:     state.ServingSince,
+		appLogger:        app.appLogger,
+		cmd:              &exec.Cmd{Process: process},
+		stdout:           os.NewFile(uintptr(state.StdoutFd), "stdout"),
+		stderr:           os.NewFile(uintptr(state.StderrFd), "stderr"),
+		exited:           make(chan struct{}),
+		stopping:         make(chan struct{}),
+		ready:            make(chan struct{}),
+	}
+	instance.setStatus(state.Status)
+	instance.lastChange = state.LastChange
+
+	if state.Ready {
+		instance.markReady()
+	}
+	if state.NotifyFd != 0 {
+		file := os.NewFile(uintptr(state.NotifyFd), state.NotifyPath)
+		if instance.notifySocket, err = AdoptNotifySocket(instance, state.NotifyPath, file); err != nil {
+			log.Printf("%s: Cannot adopt notify socket of instance %d: %s", app.config.Name, state.Id, err)
+		}
+	}
+
+	instance.instanceLogger, err = NewInstanceLogger(instance, instance.stdout, instance.stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	go instance.waitProcess()
+	switch instance.status {
+	case InstanceStatusStarting:
+		go instance.waitHealthy()
+	case InstanceStatusServing:
+		if app.config.Liveness != nil {
+			go instance.probeLiveness()
+		}
+	case InstanceStatusStopping:
+		instance.resumeStop(state.StopStep)
+	}
+
+	return instance, nil
+}
+
+// resumeStop continues stop sequence of adopted instance, its connections
+// were closed by previous daemon process
+func (i *Instance) resumeStop(step int) {
+	i.stopStep = step
+	if step == 0 {
+		i.drains++
+		go i.sendEvent(InstanceEventDrained)
+		return
+	}
+	if step <= len(i.config.stopSequence) {
+		i.stopSignals++
+		if timeout := i.config.stopSequence[step-1].Timeout; timeout > 0 {
+			go i.waitStopTimeout(i.stopSignals, time.Duration(timeout)*time.Second)
+		}
+	}
+}
+
+// Upgrade re-executes daemon binary in place. Listeners and instance output
+// pipes are inherited by new process, which adopts running instances, so
+// apps keep running and connections wait in listen queue meanwhile.
+func (d *Daemon) Upgrade() error {
+	if !atomic.CompareAndSwapInt32(&d.upgrading, 0, 1) {
+		return ErrUpgradeInProgress
+	}
+	defer atomic.StoreInt32(&d.upgrading, 0)
+
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	binary, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	// new process would exit on invalid config and take apps with it
+	if _, err := ParseConfing(d.configPath); err != nil {
+		return err
+	}
+
+	state := &DaemonState{}
+	defer func() {
+		for _, appState := range state.Apps {
+			close(appState.thaw)
+		}
+	}()
+
+	for _, app := range d.Apps() {
+		appState, err := app.freeze()
+		if err != nil {
+			return fmt.Errorf("%s: %s", app.config.Name, err)
+		}
+		state.Apps = append(state.Apps, appState)
+	}
+
+	// wait for proxied requests to finish, keep-alive connections are
+	// closed after their last request and new connections are queued on
+	// inherited listeners
+	deadline := time.Now().Add(UpgradeDrainTimeout)
+	for _, appState := range state.Apps {
+		for _, instance := range appState.instances {
+			for instance.Conns() > 0 && time.Now().Before(deadline) {
+				time.Sleep(HealthCheckInterval)
+			}
+		}
+	}
+
+	stateFd, err := writeState(state)
+	if err != nil {
+		return err
+	}
+
+	log.Print("Upgrading daemon, executing ", binary)
+	env := append(os.Environ(), fmt.Sprintf("%s=%d", UpgradeStateEnv, stateFd))
+	err = syscall.Exec(binary, os.Args, env)
+
+	// exec only returns on error
+	syscall.Close(stateFd)
+	return err
+}
+
+// writeState writes state to a file that is removed right after it is
+// created, so it can only be read through returned file descriptor
+// inherited by re-executed daemon
+func writeState(state *DaemonState) (int, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := ioutil.TempFile("", "gracevisor-state")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return inheritFd(file)
+}
+
+// adoptApps starts apps from state passed by previous daemon process
+func (d *Daemon) adoptApps(stateFd string) error {
+	fd, err := strconv.Atoi(stateFd)
+	if err != nil {
+		return err
+	}
+	file := os.NewFile(uintptr(fd), "state")
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	state := &DaemonState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+
+	configs := map[string]*AppConfig{}
+	for _, config := range d.config.Apps {
+		configs[config.Name] = config
+	}
+
+	for _, appState := range state.Apps {
+		config, ok := configs[appState.Name]
+		if appState.Config != nil {
+			runtimeConfig, err := d.parseAppConfig(appState.Config)
+			if err != nil {
+				log.Print("Cannot parse runtime app config: ", err)
+			} else {
+				if ok {
+					runtimeConfig.source = config.source
+				}
+				runtimeConfig.data = appState.Config
+				d.replaceAppConfig(runtimeConfig)
+				config, ok = runtimeConfig, true
+			}
+		}
+		if !ok {
+			// app was removed from config files meanwhile
+			log.Printf("%s: App not in config, stopping its instances", appState.Name)
+			for _, instanceState := range appState.Instances {
+				signalGroup(instanceState.Pid, syscall.SIGTERM)
+			}
+			appState.closeFds()
+			continue
+		}
+
+		app := NewApp(config, d.portPool)
+		if err := app.Adopt(appState); err != nil {
+			log.Print(appState.Name, ": ", err)
+		}
+		d.appsLock.Lock()
+		d.apps[config.Name] = app
+		d.appsLock.Unlock()
+	}
+	return nil
+}
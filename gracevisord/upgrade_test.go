@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAppFreeze(t *testing.T) {
+	port := freePort(t)
+	app := newTestApp(t, &AppConfig{Command: "sleep 30", ExternalPort: port})
+
+	if err := app.Start(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	state, err := app.freeze()
+	if err != nil {
+		t.Fatal("Freeze failed:", err)
+	}
+	if state.ListenerFd == 0 || len(state.Instances) != 1 {
+		t.Fatal("State should contain listener and instance:", state.ListenerFd, len(state.Instances))
+	}
+	instanceState := state.Instances[0]
+	if instanceState.Id != 1 || !instanceState.Active || instanceState.Status != InstanceStatusServing || instanceState.StdoutFd == 0 {
+		t.Error("Incorrect instance state:", instanceState)
+	}
+
+	// listener is closed, but connections are queued on inherited socket
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal("Inherited listener should accept connections:", err)
+	}
+	conn.Close()
+
+	close(state.thaw)
+	waitFor(t, app, "listener restored", func() bool {
+		return app.listener != nil
+	})
+}
+
+func TestAppFreezeKeepAlive(t *testing.T) {
+	port := freePort(t)
+	app := newTestApp(t, &AppConfig{Command: "sleep 30", ExternalPort: port})
+
+	if err := app.Start(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	newTestServer(t, app.instances[0], func() int { return http.StatusOK })
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request := func() error {
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+			return err
+		}
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	if err := request(); err != nil {
+		t.Fatal("Request failed:", err)
+	}
+
+	state, err := app.freeze()
+	if err != nil {
+		t.Fatal("Freeze failed:", err)
+	}
+	defer close(state.thaw)
+
+	// idle keep-alive connection must not take new requests while draining
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Error("Keep-alive connection should be closed after freeze:", err)
+	}
+}
+
+func TestAppAdopt(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	listenerFd, err := inheritFd(listener.(*net.TCPListener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	state := &AppState{
+		Name:       "test",
+		ListenerFd: listenerFd,
+		InstanceId: 3,
+		Instances: []*InstanceState{
+			{
+				Id:     3,
+				Pid:    cmd.Process.Pid,
+				Port:   20500,
+				Status: InstanceStatusServing,
+				Active: true,
+			},
+		},
+	}
+	if state.Instances[0].StdoutFd, err = inheritFd(stdout.(*os.File)); err != nil {
+		t.Fatal(err)
+	}
+	if state.Instances[0].StderrFd, err = inheritFd(stderr.(*os.File)); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t, &AppConfig{Command: "sleep 30", ExternalPort: port})
+	if err := app.Adopt(state); err != nil {
+		t.Fatal("Adopt failed:", err)
+	}
+
+	app.do(func() {
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 3 {
+			t.Error("Adopted instance should be active")
+		}
+		if len(app.instances) != 1 {
+			t.Error("No new instance should be started:", len(app.instances))
+		}
+	})
+	if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port)); err != nil {
+		t.Error("Adopted listener should accept connections:", err)
+	} else {
+		conn.Close()
+	}
+
+	if err := app.StopInstances(-1, false); err != nil {
+		t.Fatal("Stop failed:", err)
+	}
+	waitFor(t, app, "adopted instance stopped", func() bool {
+		return len(app.history) == 1 && app.history[0].Status == "stopped"
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "new instance active", func() bool {
+		return len(app.activeInstances) == 1 && app.activeInstances[0].id == 4
+	})
+}
+
+func TestDaemonAdoptRuntimeApp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracevisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestConfig(t, dir, testAppConfig("a", "sleep 30", freePort(t)))
+	config, err := ParseConfing(dir)
+	if err != nil {
+		t.Fatal("Parse config failed:", err)
+	}
+	daemon := NewDaemon(dir, config)
+	defer func() {
+		for _, app := range daemon.Apps() {
+			app.Shutdown()
+		}
+	}()
+
+	cmd := exec.Command("sleep", "30")
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	// app b was added over rpc without persist
+	appState := &AppState{
+		Name:       "b",
+		InstanceId: 1,
+		Config:     []byte(fmt.Sprintf("name: b\ncommand: sleep 30\nenvironment: [\"PORT={port}\"]\nexternal_port: %d\n", freePort(t))),
+		Instances: []*InstanceState{
+			{
+				Id:     1,
+				Pid:    cmd.Process.Pid,
+				Port:   20500,
+				Status: InstanceStatusServing,
+				Active: true,
+			},
+		},
+	}
+	if appState.Instances[0].StdoutFd, err = inheritFd(stdout.(*os.File)); err != nil {
+		t.Fatal(err)
+	}
+	if appState.Instances[0].StderrFd, err = inheritFd(stderr.(*os.File)); err != nil {
+		t.Fatal(err)
+	}
+	stateFd, err := writeState(&DaemonState{Apps: []*AppState{appState}})
+	if err != nil {
+		t.Fatal("Write state failed:", err)
+	}
+
+	if err := daemon.adoptApps(strconv.Itoa(stateFd)); err != nil {
+		t.Fatal("Adopt apps failed:", err)
+	}
+	app, ok := daemon.App("b")
+	if !ok {
+		t.Fatal("Runtime app should be adopted")
+	}
+	app.do(func() {
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 1 {
+			t.Error("Instance of runtime app should be adopted")
+		}
+	})
+	if len(daemon.config.Apps) != 2 || daemon.config.Apps[1].data == nil {
+		t.Error("Runtime app config should be recorded:", len(daemon.config.Apps))
+	}
+}
+
+func TestWriteState(t *testing.T) {
+	fd, err := writeState(&DaemonState{Apps: []*AppState{{Name: "test", InstanceId: 3}}})
+	if err != nil {
+		t.Fatal("Write state failed:", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "state")
+	defer file.Close()
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil || stat.Nlink != 0 || stat.Mode&0077 != 0 {
+		t.Error("State file should be removed and private:", stat.Nlink, stat.Mode, err)
+	}
+
+	state := &DaemonState{}
+	if err := json.NewDecoder(file).Decode(state); err != nil || len(state.Apps) != 1 || state.Apps[0].InstanceId != 3 {
+		t.Error("State should be readable from file descriptor:", state.Apps, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Run replays warmup request against instance until instance exits and
+// returns number of failed requests
+func (c *WarmupConfig) Run(instance *Instance) int64 {
+	warmupUrl := fmt.Sprintf("http://%s%s", instance.internalHostPort, c.Path)
+	client := &http.Client{Timeout: time.Duration(c.Timeout) * time.Second}
+
+	var failed int64
+	requests := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for n := 0; n < c.Concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range requests {
+				if err := c.request(client, warmupUrl); err != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+send:
+	for n := 0; n < c.Repeat; n++ {
+		select {
+		case requests <- struct{}{}:
+		case <-instance.exited:
+			break send
+		}
+	}
+	close(requests)
+	wg.Wait()
+
+	return failed
+}
+
+func (c *WarmupConfig) request(client *http.Client, warmupUrl string) error {
+	req, err := http.NewRequest(c.Method, warmupUrl, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Unexpected warmup status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// warmup replays warmup requests against healthy instance before it
+// receives traffic, failed requests are only logged
+func (i *Instance) warmup() {
+	for _, config := range i.config.Warmup {
+		if failed := config.Run(i); failed > 0 {
+			log.Printf("%s: %d of %d warmup requests %s %s to instance %d failed", i.config.Name, failed, config.Repeat, config.Method, config.Path, i.id)
+		}
+	}
+}
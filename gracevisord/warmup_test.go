@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInstanceWarmup(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:     "sleep 30",
+		HealthCheck: &HealthCheckConfig{Path: "/health"},
+		Warmup: []*WarmupConfig{
+			{Path: "/warm?cache=1", Repeat: 20, Concurrency: 4},
+			{Method: "POST", Path: "/fail"},
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+
+	var instance *Instance
+	app.do(func() {
+		instance = app.instances[0]
+	})
+
+	var warm, failed int64
+	listener, err := net.Listen("tcp", instance.internalHostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/warm" && r.Method == "GET" && r.URL.Query().Get("cache") == "1":
+			atomic.AddInt64(&warm, 1)
+		case r.URL.Path == "/fail" && r.Method == "POST":
+			atomic.AddInt64(&failed, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	waitFor(t, app, "instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+	if atomic.LoadInt64(&warm) != 20 || atomic.LoadInt64(&failed) != 1 {
+		t.Error("Warmup requests should be sent before instance is active:", warm, failed)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const WatchCheckInterval = time.Second
+
+type requestCounters struct {
+	requests int64
+	errors   int64
+}
+
+func (c requestCounters) errorRate() float64 {
+	if c.requests == 0 {
+		return 0
+	}
+	return float64(c.errors) / float64(c.requests) * 100
+}
+
+// Watch keeps replaced instances alive for a while after traffic was
+// switched and compares error rate of new instances with their baseline
+type Watch struct {
+	old      []*Instance
+	new      []*Instance
+	counters map[*Instance]requestCounters
+	start    time.Time
+	done     chan struct{}
+}
+
+// retire stops instances that were replaced by new ones. If rollback is
+// configured, they are kept alive until watch window ends.
+func (a *App) retire(old, new []*Instance) {
+	if a.config.Rollback == nil {
+		for _, instance := range old {
+			instance.Stop()
+		}
+		return
+	}
+
+	if a.watch == nil {
+		a.startWatch()
+	}
+	w := a.watch
+	for _, instance := range append(old, new...) {
+		w.counters[instance] = instance.RequestCounters()
+	}
+	w.old = append(w.old, old...)
+	w.new = append(w.new, new...)
+	w.start = time.Now()
+}
+
+func (a *App) startWatch() {
+	w := &Watch{
+		counters: map[*Instance]requestCounters{},
+		done:     make(chan struct{}),
+	}
+	a.watch = w
+
+	go func() {
+		ticker := time.NewTicker(WatchCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.post(func() {
+					if a.watch == w {
+						a.checkWatch()
+					}
+				})
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// endWatch stops watching and optionally stops replaced instances
+func (a *App) endWatch(stopOld bool) {
+	w := a.watch
+	a.watch = nil
+	close(w.done)
+
+	if !stopOld {
+		return
+	}
+	for _, instance := range w.old {
+		if instance.status == InstanceStatusServing && !instance.active {
+			instance.Stop()
+		}
+	}
+}
+
+func (a *App) checkWatch() {
+	w := a.watch
+	config := a.config.Rollback
+
+	baseline := requestCounters{}
+	for _, instance := range w.old {
+		baseline.requests += w.counters[instance].requests
+		baseline.errors += w.counters[instance].errors
+	}
+
+	current := requestCounters{}
+	for _, instance := range w.new {
+		counters := instance.RequestCounters()
+		current.requests += counters.requests - w.counters[instance].requests
+		current.errors += counters.errors - w.counters[instance].errors
+	}
+
+	if current.requests >= int64(config.MinRequests) && current.errorRate()-baseline.errorRate() > config.Threshold {
+		a.rollback(current.errorRate(), baseline.errorRate())
+		return
+	}
+
+	if time.Since(w.start) >= time.Duration(config.Window)*time.Second {
+		a.endWatch(true)
+	}
+}
+
+// rollback moves traffic back to replaced instances and stops new ones
+func (a *App) rollback(errorRate, baselineErrorRate float64) {
+	w := a.watch
+	a.endWatch(false)
+
+	old := []*Instance{}
+	for _, instance := range w.old {
+		if instance.status == InstanceStatusServing {
+			old = append(old, instance)
+		}
+	}
+	if len(old) == 0 {
+		log.Printf("%s: Cannot roll back, replaced instances are not running", a.config.Name)
+		return
+	}
+
+	// stop rolling restart in progress
+	a.replacing = nil
+	for _, instance := range a.instances {
+		if instance.status == InstanceStatusStarting && instance.replaces != nil {
+			instance.replaces = nil
+			instance.Stop()
+		}
+	}
+
+	rolledBack := map[*Instance]bool{}
+	for _, instance := range w.new {
+		rolledBack[instance] = true
+	}
+
+	active := []*Instance{}
+	for _, instance := range a.activeInstances {
+		if !rolledBack[instance] {
+			active = append(active, instance)
+		}
+	}
+	for _, instance := range old {
+		instance.setActive(true)
+	}
+	a.setActiveInstances(append(active, old...))
+
+	ids := []uint32{}
+	for _, instance := range w.new {
+		ids = append(ids, instance.id)
+		instance.setActive(false)
+		if instance.status == InstanceStatusServing {
+			instance.Stop()
+		}
+	}
+
+	a.lastRollback = &report.Rollback{
+		Time:              time.Now().Unix(),
+		Instances:         ids,
+		ErrorRate:         errorRate,
+		BaselineErrorRate: baselineErrorRate,
+	}
+	log.Printf("%s: Rolled back instances %v, error rate %.1f%% exceeds baseline %.1f%%", a.config.Name, ids, errorRate, baselineErrorRate)
+	a.progressf("Rolled back instances %v, error rate %.1f%% exceeds baseline %.1f%%", ids, errorRate, baselineErrorRate)
+}
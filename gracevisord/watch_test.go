@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppRollback(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command: "sleep 30",
+		Rollback: &RollbackConfig{
+			Window:      30,
+			Threshold:   10,
+			MinRequests: 10,
+		},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+	for i := 0; i < 100; i++ {
+		app.activeInstances[0].RecordRequest(i%50 == 0)
+	}
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	waitFor(t, app, "second instance active", func() bool {
+		return len(app.activeInstances) == 1 && app.activeInstances[0].id == 2
+	})
+	app.do(func() {
+		if app.watch == nil {
+			t.Error("Watch should start after switch")
+			return
+		}
+		if app.instances[0].status != InstanceStatusServing {
+			t.Error("Replaced instance should be kept alive during watch")
+		}
+		for i := 0; i < 20; i++ {
+			app.instances[1].RecordRequest(i%4 == 0)
+		}
+	})
+
+	waitFor(t, app, "rollback", func() bool {
+		return app.lastRollback != nil
+	})
+	app.do(func() {
+		if len(app.activeInstances) != 1 || app.activeInstances[0].id != 1 {
+			t.Error("Rollback should move traffic to old instance")
+		}
+		if app.instances[1].status == InstanceStatusServing {
+			t.Error("Rollback should stop new instance")
+		}
+		if app.lastRollback.ErrorRate != 25 || app.lastRollback.BaselineErrorRate != 2 {
+			t.Error("Incorrect rollback error rates:", app.lastRollback)
+		}
+	})
+}
+
+func TestAppWatchWindow(t *testing.T) {
+	app := newTestApp(t, &AppConfig{
+		Command:  "sleep 30",
+		Rollback: &RollbackConfig{Window: 1},
+	})
+
+	if err := app.Restart(); err != nil {
+		t.Fatal("Start failed:", err)
+	}
+	waitFor(t, app, "first instance active", func() bool {
+		return len(app.activeInstances) == 1
+	})
+	if err := app.Restart(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	waitFor(t, app, "watch window end", func() bool {
+		return app.watch == nil && app.instances[0].status != InstanceStatusServing
+	})
+	app.do(func() {
+		if app.lastRollback != nil {
+			t.Error("App without errors should not be rolled back")
+		}
+	})
+}